@@ -0,0 +1,244 @@
+package main
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+/*
+ * Advisors and their sign-off of degree sheets. Students pick their advisors
+ * among the users with the advisor role. An advisor can read the sheets of
+ * their advisees and approve a sheet's satisfaction mapping or the student's
+ * planned courses. An approval records a fingerprint of what was approved,
+ * and stops being valid as soon as the student changes it, or the advisor
+ * stops advising them.
+ */
+
+const ROLE_STUDENT = "student"
+const ROLE_ADVISOR = "advisor"
+
+const APPROVAL_MAPPING = "mapping"
+const APPROVAL_PLAN = "plan"
+
+type SheetApproval struct {
+	Id          int64
+	Sheet_id    int64
+	Advisor_id  int64
+	Advisor     string
+	Kind        string
+	Approved    time.Time
+	Fingerprint string
+	// Whether the sheet still matches what was approved
+	Valid bool
+}
+
+func IsAdvisorOf(db sqlQueryer, advisor_id int64, advisee_id int64) (bool, error) {
+	var count int64
+	err := db.QueryRow(`SELECT COUNT(*) FROM advisor_advisee
+		WHERE advisor_id = ? AND advisee_id = ?`, advisor_id, advisee_id).Scan(&count)
+	return count > 0, err
+}
+
+func AddAdvisor(db sqlQueryer, advisor_id int64, advisee_id int64) error {
+	_, err := db.Exec(`INSERT IGNORE INTO advisor_advisee (advisor_id, advisee_id)
+		VALUES (?, ?)`, advisor_id, advisee_id)
+	return err
+}
+
+// Remove an advisor of a student, along with their approvals of the
+// student's sheets
+func RemoveAdvisor(db *sql.DB, advisor_id int64, advisee_id int64) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`DELETE FROM advisor_advisee
+		WHERE advisor_id = ? AND advisee_id = ?`, advisor_id, advisee_id)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	_, err = tx.Exec(`DELETE sheet_approval FROM sheet_approval
+		JOIN degree_sheet ON degree_sheet.id = sheet_approval.sheet_id
+		WHERE sheet_approval.advisor_id = ? AND degree_sheet.user_id = ?`,
+		advisor_id, advisee_id)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// Get the advisees of an advisor, or the advisors of an advisee
+func get_advisor_links(db *sql.DB, query string, user_id int64) ([]*UserData, error) {
+	rows, err := db.Query(query, user_id)
+	if err != nil {
+		return nil, err
+	}
+	user_ids := make([]int64, 0)
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		user_ids = append(user_ids, id)
+	}
+	rows.Close()
+
+	users := make([]*UserData, 0)
+	for _, id := range user_ids {
+		user, err := GetUserById(db, id)
+		if err != nil {
+			return nil, err
+		}
+		users = append(users, user)
+	}
+	return users, nil
+}
+
+func GetAdvisees(db *sql.DB, advisor_id int64) ([]*UserData, error) {
+	return get_advisor_links(db, `SELECT advisee_id FROM advisor_advisee
+		WHERE advisor_id = ? ORDER BY advisee_id`, advisor_id)
+}
+
+func GetAdvisors(db *sql.DB, advisee_id int64) ([]*UserData, error) {
+	return get_advisor_links(db, `SELECT advisor_id FROM advisor_advisee
+		WHERE advisee_id = ? ORDER BY advisor_id`, advisee_id)
+}
+
+// Fingerprints of what each kind of approval covers on a sheet as it is now,
+// by kind
+func SheetFingerprints(db *sql.DB, sheet *DegreeSheet) (map[string]string, error) {
+	audit, err := AuditDegreeSheet(db, sheet)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]string{
+		APPROVAL_MAPPING: approval_fingerprint(sheet, audit, APPROVAL_MAPPING),
+		APPROVAL_PLAN:    approval_fingerprint(sheet, audit, APPROVAL_PLAN),
+	}, nil
+}
+
+// Fingerprint of what an approval of a kind covers on a sheet. A mapping
+// approval covers the course the audit counts for each requirement, which
+// also changes when a course or grade the audit picked from changes.
+func approval_fingerprint(sheet *DegreeSheet, audit *AuditResult, kind string) string {
+	entries := make([]string, 0)
+	if kind == APPROVAL_MAPPING {
+		entries = append(entries, fmt.Sprintf("template:%d", sheet.Template_id))
+		var walk func(requirements []*AuditRequirement)
+		walk = func(requirements []*AuditRequirement) {
+			for _, requirement := range requirements {
+				for _, course := range requirement.Courses {
+					entries = append(entries, fmt.Sprintf("%s=%d@%d:%s:%t",
+						requirement.Requirement_id, course.Class_id,
+						term_index(course.Year, course.Semester), course.Grade,
+						course.Passfail))
+				}
+				walk(requirement.Children)
+			}
+		}
+		walk(audit.Requirements)
+	} else {
+		for _, planned_class := range sheet.Planned_courses {
+			entries = append(entries, fmt.Sprintf("%d@%d.%d", planned_class.Class_id,
+				planned_class.Year.Int64, planned_class.Semester.Int64))
+		}
+	}
+	sort.Strings(entries)
+	hash := sha256.Sum256([]byte(strings.Join(entries, "\n")))
+	return hex.EncodeToString(hash[:])
+}
+
+// Record an advisor's approval of the state of a sheet with a fingerprint,
+// replacing their earlier approval of the same kind
+func ApproveSheet(db *sql.DB, sheet *DegreeSheet, advisor_id int64, kind string,
+	fingerprint string) (*SheetApproval, error) {
+	approval := &SheetApproval{
+		Sheet_id:    sheet.Id,
+		Advisor_id:  advisor_id,
+		Kind:        kind,
+		Approved:    time.Now(),
+		Fingerprint: fingerprint,
+		Valid:       true,
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	_, err = tx.Exec(`DELETE FROM sheet_approval
+		WHERE sheet_id = ? AND advisor_id = ? AND kind = ?`,
+		sheet.Id, advisor_id, kind)
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	result, err := tx.Exec(`INSERT INTO sheet_approval
+		(sheet_id, advisor_id, kind, approved, fingerprint) VALUES (?, ?, ?, ?, ?)`,
+		approval.Sheet_id, approval.Advisor_id, approval.Kind, approval.Approved,
+		approval.Fingerprint)
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	if approval.Id, err = result.LastInsertId(); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	return approval, tx.Commit()
+}
+
+// The approvals of a sheet and the fingerprints of the sheet as it is now,
+// which an advisor approving it must pass back
+type SheetApprovals struct {
+	Fingerprints map[string]string
+	Approvals    []*SheetApproval
+}
+
+// Get the approvals of a sheet. Approvals are no longer valid once the sheet
+// no longer matches the fingerprints, or the advisor lost the advisor role.
+func GetApprovalsForSheet(db *sql.DB, sheet *DegreeSheet,
+	fingerprints map[string]string) (*SheetApprovals, error) {
+	rows, err := db.Query(`SELECT sheet_approval.id, sheet_approval.sheet_id,
+		sheet_approval.advisor_id, user.username, user.role, sheet_approval.kind,
+		sheet_approval.approved, sheet_approval.fingerprint
+		FROM sheet_approval, degreesheep.user AS user
+		WHERE user.id = sheet_approval.advisor_id AND sheet_approval.sheet_id = ?
+		ORDER BY sheet_approval.approved`, sheet.Id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	approvals := &SheetApprovals{
+		Fingerprints: fingerprints,
+		Approvals:    make([]*SheetApproval, 0),
+	}
+	for rows.Next() {
+		approval := new(SheetApproval)
+		var role string
+		if err := rows.Scan(
+			&approval.Id,
+			&approval.Sheet_id,
+			&approval.Advisor_id,
+			&approval.Advisor,
+			&role,
+			&approval.Kind,
+			&approval.Approved,
+			&approval.Fingerprint); err != nil {
+			return nil, err
+		}
+		// Approvals by the owner of the sheet never count
+		approval.Valid = role == ROLE_ADVISOR && approval.Advisor_id != sheet.User_id &&
+			approval.Fingerprint == fingerprints[approval.Kind]
+		approvals.Approvals = append(approvals.Approvals, approval)
+	}
+	return approvals, rows.Err()
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"database/sql/driver"
+	"testing"
+	"time"
+)
+
+func TestApprovalFingerprint(t *testing.T) {
+	comp11, comp15, comp40 := test_class(11, 1), test_class(15, 1), test_class(40, 1)
+	template := test_template(1,
+		test_class_rule(1, comp11),
+		test_category_rule(2, RULE_CATEGORY, comp15, comp40))
+
+	// A sheet counting COMP 11 and COMP 15 with COMP 40 left over, and a
+	// change to make to it
+	sheet := func(change func(sheet *DegreeSheet)) *DegreeSheet {
+		sheet := &DegreeSheet{
+			Id:          1,
+			Template_id: template.Id,
+			Taken_courses: []*TakenCourse{
+				test_course(100, comp11, "A", false),
+				test_course(101, comp15, "B", false),
+				test_course(102, comp40, "C", false),
+			},
+			Planned_courses: []*PlannedClass{test_planned(comp40, 2016, 1)},
+			Dropped_courses: make(SatisfactionMap),
+		}
+		if change != nil {
+			change(sheet)
+		}
+		return sheet
+	}
+	fingerprints := func(sheet *DegreeSheet) map[string]string {
+		audit := AuditTemplate(template, sheet.Taken_courses, nil, sheet.Dropped_courses)
+		return map[string]string{
+			APPROVAL_MAPPING: approval_fingerprint(sheet, audit, APPROVAL_MAPPING),
+			APPROVAL_PLAN:    approval_fingerprint(sheet, audit, APPROVAL_PLAN),
+		}
+	}
+	original := fingerprints(sheet(nil))
+
+	cases := []struct {
+		name   string
+		change func(sheet *DegreeSheet)
+		// Which fingerprints the change invalidates
+		mapping bool
+		plan    bool
+	}{
+		{"no change", func(sheet *DegreeSheet) {}, false, false},
+		{"grade of a counted course", func(sheet *DegreeSheet) {
+			sheet.Taken_courses[1].Grade = "B+"
+		}, true, false},
+		{"term of a counted course", func(sheet *DegreeSheet) {
+			sheet.Taken_courses[0].Year = 2016
+		}, true, false},
+		{"mapping", func(sheet *DegreeSheet) {
+			sheet.Dropped_courses["2"] = 102
+		}, true, false},
+		{"different template", func(sheet *DegreeSheet) {
+			sheet.Template_id = 2
+		}, true, false},
+		{"grade of a course the audit doesn't count", func(sheet *DegreeSheet) {
+			sheet.Taken_courses[2].Grade = "A"
+		}, false, false},
+		{"term of a planned class", func(sheet *DegreeSheet) {
+			sheet.Planned_courses[0].Semester.Int64 = 2
+		}, false, true},
+		{"another planned class", func(sheet *DegreeSheet) {
+			sheet.Planned_courses = append(sheet.Planned_courses, test_planned(comp15, 0, 0))
+		}, false, true},
+	}
+	for _, c := range cases {
+		changed := fingerprints(sheet(c.change))
+		if (changed[APPROVAL_MAPPING] != original[APPROVAL_MAPPING]) != c.mapping {
+			t.Errorf("%s: mapping fingerprint changed %v, want %v", c.name, !c.mapping, c.mapping)
+		}
+		if (changed[APPROVAL_PLAN] != original[APPROVAL_PLAN]) != c.plan {
+			t.Errorf("%s: plan fingerprint changed %v, want %v", c.name, !c.plan, c.plan)
+		}
+	}
+}
+
+func TestGetApprovalsForSheet(t *testing.T) {
+	approved := time.Date(2016, time.March, 1, 0, 0, 0, 0, time.UTC)
+	db, _ := open_test_db(&testResult{pattern: "FROM sheet_approval, degreesheep.user", rows: [][]driver.Value{
+		{int64(1), int64(1), int64(7), "advisor", ROLE_ADVISOR, APPROVAL_MAPPING, approved, "current"},
+		{int64(2), int64(1), int64(8), "other", ROLE_ADVISOR, APPROVAL_PLAN, approved, "stale"},
+		{int64(3), int64(1), int64(9), "former", ROLE_STUDENT, APPROVAL_MAPPING, approved, "current"},
+		{int64(4), int64(1), int64(5), "owner", ROLE_ADVISOR, APPROVAL_MAPPING, approved, "current"},
+	}})
+	sheet := &DegreeSheet{Id: 1, User_id: 5}
+	fingerprints := map[string]string{APPROVAL_MAPPING: "current", APPROVAL_PLAN: "now"}
+
+	approvals, err := GetApprovalsForSheet(db, sheet, fingerprints)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Only an advisor other than the owner approving the sheet as it is now
+	want := []bool{true, false, false, false}
+	if len(approvals.Approvals) != len(want) {
+		t.Fatalf("got %d approvals, want %d", len(approvals.Approvals), len(want))
+	}
+	for i, approval := range approvals.Approvals {
+		if approval.Valid != want[i] {
+			t.Errorf("approval by %s: valid %v, want %v", approval.Advisor, approval.Valid, want[i])
+		}
+	}
+}
@@ -19,6 +19,7 @@ type ApiResult struct {
 	Success   int
 	Return    interface{}
 	Error     string
+	Warnings  []string `json:",omitempty"`
 	errorCode int
 }
 
@@ -188,6 +189,16 @@ func APIError(error string, errcode int) *ApiResult {
 	}
 }
 
+// An error that also carries data describing what went wrong
+func APIErrorWithData(error string, errcode int, data interface{}) *ApiResult {
+	return &ApiResult{
+		Success:   0,
+		Error:     error,
+		errorCode: errcode,
+		Return:    data,
+	}
+}
+
 func APISuccess(result interface{}) *ApiResult {
 	return &ApiResult{
 		Success: 1,
@@ -195,6 +206,16 @@ func APISuccess(result interface{}) *ApiResult {
 	}
 }
 
+// A successful result that the user should still be told about, e.g. a class
+// planned before its prerequisites
+func APISuccessWithWarnings(result interface{}, warnings []string) *ApiResult {
+	return &ApiResult{
+		Success:  1,
+		Return:   result,
+		Warnings: warnings,
+	}
+}
+
 // JSON encode an ApiResult and write it to the HTTP response.
 // Also sets the error code if the ApiResult is an error.
 func ServeData(w http.ResponseWriter, r *http.Request, data *ApiResult) {
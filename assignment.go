@@ -0,0 +1,177 @@
+package main
+
+import (
+	"sort"
+)
+
+/*
+ * Assignment of taken courses to template requirements. Requirements and
+ * courses form a bipartite graph, with an edge wherever a course is eligible
+ * for a requirement. A maximum matching over that graph satisfies as many
+ * requirements as the student's courses allow.
+ */
+
+// Decide which taken course satisfies each slot of a template. Each
+// course is only ever used once. Valid entries of the saved satisfaction map
+// are used as the starting point; the matching may move a course to a
+// different requirement, but never leaves a requirement from the map
+// unsatisfied.
+func assign_courses(template *DSCategory, taken []*TakenCourse,
+	sat_map SatisfactionMap) map[string]*TakenCourse {
+	slots := template_slots(template)
+
+	// Build the edges from each requirement to its eligible courses
+	edges := make([][]int, len(slots))
+	course_index := make(map[int64]int)
+	for i, course := range taken {
+		course_index[course.Id] = i
+	}
+	for i, slot := range slots {
+		edges[i] = make([]int, 0)
+		for j, course := range taken {
+			if rule_accepts_course(slot.Rule, course) {
+				edges[i] = append(edges[i], j)
+			}
+		}
+	}
+
+	// course_match[course] holds the requirement a course is assigned to
+	course_match := make([]int, len(taken))
+	for i := range course_match {
+		course_match[i] = -1
+	}
+	slot_matched := make([]bool, len(slots))
+
+	// Seed the matching with the saved mapping
+	for i, slot := range slots {
+		satisfier_id, mapped := sat_map[slot.Id]
+		if !mapped {
+			continue
+		}
+		j, exists := course_index[satisfier_id]
+		if !exists || course_match[j] >= 0 || !rule_accepts_course(slot.Rule, taken[j]) {
+			continue
+		}
+		course_match[j] = i
+		slot_matched[i] = true
+	}
+
+	// Grow the matching along augmenting paths. Class rules go first so that
+	// they get their class where a category rule could use another course,
+	// and the alternatives of a RULE_SELECT go last so they don't take
+	// courses that are needed elsewhere.
+	priority := func(slot *requirementSlot) int {
+		if slot.Optional {
+			return 2
+		} else if slot.Rule.Ruletype == RULE_CLASS {
+			return 0
+		}
+		return 1
+	}
+	grow := func() {
+		for pass := 0; pass <= 2; pass++ {
+			for i, slot := range slots {
+				if priority(slot) != pass || slot_matched[i] {
+					continue
+				}
+				visited := make([]bool, len(taken))
+				if find_augmenting_path(i, edges, course_match, visited) {
+					slot_matched[i] = true
+				}
+			}
+		}
+	}
+	grow()
+
+	// Credits rules have a slot for every course they could need. Keep the
+	// courses worth the most credits until the rule is met, in its first
+	// slots, and free the rest for other requirements.
+	rule_slots := make(map[*DSCategoryRule][]int)
+	credit_rules := make([]*DSCategoryRule, 0)
+	for i, slot := range slots {
+		if slot.Rule.Ruletype != RULE_CREDITS {
+			continue
+		}
+		if _, seen := rule_slots[slot.Rule]; !seen {
+			credit_rules = append(credit_rules, slot.Rule)
+		}
+		rule_slots[slot.Rule] = append(rule_slots[slot.Rule], i)
+	}
+	for _, rule := range credit_rules {
+		courses := make([]int, 0)
+		for _, i := range rule_slots[rule] {
+			for j := range course_match {
+				if course_match[j] == i {
+					courses = append(courses, j)
+					course_match[j] = -1
+				}
+			}
+			slot_matched[i] = false
+			// The kept courses stay where they are while the rest is
+			// matched again
+			edges[i] = []int{}
+		}
+		sort.SliceStable(courses, func(a, b int) bool {
+			return taken_course_credits(taken[courses[a]]) > taken_course_credits(taken[courses[b]])
+		})
+		credits := 0.0
+		for k, j := range courses {
+			if credits >= rule.Min_credits.Float64 {
+				break
+			}
+			course_match[j] = rule_slots[rule][k]
+			slot_matched[rule_slots[rule][k]] = true
+			credits += taken_course_credits(taken[j])
+		}
+	}
+
+	// Courses freed from credits rules can satisfy requirements that are
+	// still open
+	if len(credit_rules) > 0 {
+		grow()
+	}
+
+	assignment := make(map[string]*TakenCourse)
+	for j, i := range course_match {
+		if i >= 0 {
+			assignment[slots[i].Id] = taken[j]
+		}
+	}
+	return assignment
+}
+
+func taken_course_credits(course *TakenCourse) float64 {
+	if course.Class == nil {
+		return 0
+	}
+	return class_credits(course.Class)
+}
+
+// Try to find a course for a requirement, moving already matched courses to
+// other requirements where needed (Kuhn's algorithm).
+func find_augmenting_path(slot int, edges [][]int, course_match []int,
+	visited []bool) bool {
+	for _, course := range edges[slot] {
+		if visited[course] {
+			continue
+		}
+		visited[course] = true
+		if course_match[course] < 0 ||
+			find_augmenting_path(course_match[course], edges, course_match, visited) {
+			course_match[course] = slot
+			return true
+		}
+	}
+	return false
+}
+
+// Compute the satisfaction map that satisfies the most requirements of a
+// template with the given courses.
+func ProposeSatisfactionMap(template *DSCategory, taken []*TakenCourse,
+	sat_map SatisfactionMap) SatisfactionMap {
+	proposal := make(SatisfactionMap)
+	for requirement, course := range assign_courses(template, taken, sat_map) {
+		proposal[requirement] = course.Id
+	}
+	return proposal
+}
@@ -0,0 +1,281 @@
+package main
+
+import (
+	"database/sql"
+	"testing"
+)
+
+func test_class(number int64, credits float64) *Class {
+	return &Class{
+		Id:               number,
+		Subject_callsign: "COMP",
+		Course_number:    number,
+		Credits:          credits,
+	}
+}
+
+func test_course(id int64, class *Class, grade string, passfail bool) *TakenCourse {
+	return &TakenCourse{
+		Id:       id,
+		Class_id: class.Id,
+		Class:    class,
+		Year:     2015,
+		Semester: 2,
+		Grade:    grade,
+		Passfail: passfail,
+	}
+}
+
+func test_class_rule(id int64, class *Class) *DSCategoryRule {
+	return &DSCategoryRule{
+		Id:               id,
+		Ruletype:         RULE_CLASS,
+		Class_id:         sql.NullInt64{Int64: class.Id, Valid: true},
+		Passfail_allowed: true,
+		class:            class,
+	}
+}
+
+func test_category_rule(id int64, ruletype int64, classes ...*Class) *DSCategoryRule {
+	return &DSCategoryRule{
+		Id:               id,
+		Ruletype:         ruletype,
+		Category_id:      sql.NullInt64{Int64: id, Valid: true},
+		Passfail_allowed: true,
+		class_category:   &ClassCategory{Id: int(id), Name: "Electives", Classes: classes},
+	}
+}
+
+func test_inherit_rule(id int64, inherited *DSCategory) *DSCategoryRule {
+	return &DSCategoryRule{
+		Id:         id,
+		Ruletype:   RULE_INHERIT,
+		Inherit_id: sql.NullInt64{Int64: inherited.Id, Valid: true},
+		inherited:  inherited,
+	}
+}
+
+func test_template(id int64, rules ...*DSCategoryRule) *DSCategory {
+	return &DSCategory{Id: id, Name: "Template", Rules: rules}
+}
+
+func TestAssignCourses(t *testing.T) {
+	comp11, comp15, comp40 := test_class(11, 1), test_class(15, 1), test_class(40, 1)
+
+	no_passfail := test_category_rule(2, RULE_CATEGORY, comp11)
+	no_passfail.Passfail_allowed = false
+
+	count := test_category_rule(3, RULE_COUNT, comp11, comp15, comp40)
+	count.Min_count = sql.NullInt64{Int64: 2, Valid: true}
+
+	min_grade := test_class_rule(2, comp15)
+	min_grade.Min_grade = sql.NullString{String: "C-", Valid: true}
+
+	shared := test_template(20, test_class_rule(21, comp40))
+
+	half, one, one_half := test_class(50, 0.5), test_class(51, 1), test_class(52, 1.5)
+	other_half := test_class(53, 0.5)
+	credits := test_category_rule(4, RULE_CREDITS, half, one, one_half, other_half)
+	credits.Min_credits = sql.NullFloat64{Float64: 2.5, Valid: true}
+	select_half := test_inherit_rule(5, test_template(30, test_class_rule(31, other_half)))
+	select_half.Ruletype = RULE_SELECT
+
+	cases := []struct {
+		name     string
+		template *DSCategory
+		taken    []*TakenCourse
+		sat_map  SatisfactionMap
+		// Course ID assigned to each requirement slot, 0 for any course
+		want map[string]int64
+	}{
+		{
+			name: "class rule keeps its class from a category rule",
+			template: test_template(1,
+				test_category_rule(1, RULE_CATEGORY, comp11, comp15),
+				test_class_rule(2, comp15)),
+			taken: []*TakenCourse{
+				test_course(100, comp15, "A", false),
+				test_course(101, comp11, "B", false),
+			},
+			want: map[string]int64{"1": 101, "2": 100},
+		},
+		{
+			name: "augmenting path moves a course to free it",
+			template: test_template(1,
+				test_category_rule(1, RULE_CATEGORY, comp11, comp15),
+				test_category_rule(2, RULE_CATEGORY, comp15)),
+			taken: []*TakenCourse{
+				test_course(100, comp15, "A", false),
+				test_course(101, comp11, "B", false),
+			},
+			want: map[string]int64{"1": 101, "2": 100},
+		},
+		{
+			name:     "failed course",
+			template: test_template(1, test_class_rule(1, comp15)),
+			taken:    []*TakenCourse{test_course(100, comp15, "F", false)},
+			want:     map[string]int64{},
+		},
+		{
+			name: "saved mapping is the starting point",
+			template: test_template(1,
+				test_category_rule(1, RULE_CATEGORY, comp11, comp15),
+				test_category_rule(2, RULE_CATEGORY, comp11, comp15)),
+			taken:   []*TakenCourse{test_course(100, comp15, "A", false)},
+			sat_map: SatisfactionMap{"2": 100},
+			want:    map[string]int64{"2": 100},
+		},
+		{
+			name:     "ineligible saved mapping is ignored",
+			template: test_template(1, test_class_rule(1, comp11), test_class_rule(2, comp15)),
+			taken: []*TakenCourse{
+				test_course(100, comp15, "A", false),
+				test_course(101, comp11, "B", false),
+			},
+			sat_map: SatisfactionMap{"1": 100},
+			want:    map[string]int64{"1": 101, "2": 100},
+		},
+		{
+			name:     "pass/fail course on a rule that forbids it",
+			template: test_template(1, no_passfail),
+			taken:    []*TakenCourse{test_course(100, comp11, "P", true)},
+			want:     map[string]int64{},
+		},
+		{
+			name: "pass/fail course goes to a rule that allows it",
+			template: test_template(1,
+				no_passfail,
+				test_category_rule(3, RULE_CATEGORY, comp11)),
+			taken: []*TakenCourse{test_course(100, comp11, "P", true)},
+			want:  map[string]int64{"3": 100},
+		},
+		{
+			name:     "count rule only takes as many courses as it needs",
+			template: test_template(1, count),
+			taken: []*TakenCourse{
+				test_course(100, comp11, "A", false),
+				test_course(101, comp15, "A", false),
+				test_course(102, comp40, "A", false),
+			},
+			want: map[string]int64{"3.1": 0, "3.2": 0},
+		},
+		{
+			name:     "count rule partly met",
+			template: test_template(1, count),
+			taken:    []*TakenCourse{test_course(100, comp40, "A", false)},
+			want:     map[string]int64{"3.1": 100},
+		},
+		{
+			name:     "grade below the minimum",
+			template: test_template(1, min_grade),
+			taken:    []*TakenCourse{test_course(100, comp15, "D", false)},
+			want:     map[string]int64{},
+		},
+		{
+			name:     "grade at the minimum",
+			template: test_template(1, min_grade),
+			taken:    []*TakenCourse{test_course(100, comp15, "C-", false)},
+			want:     map[string]int64{"2": 100},
+		},
+		{
+			name:     "pass does not meet a minimum grade",
+			template: test_template(1, min_grade),
+			taken:    []*TakenCourse{test_course(100, comp15, "P", true)},
+			want:     map[string]int64{},
+		},
+		{
+			name: "template inherited twice only counts once",
+			template: test_template(1,
+				test_inherit_rule(1, shared),
+				test_inherit_rule(2, shared)),
+			taken: []*TakenCourse{
+				test_course(100, comp40, "A", false),
+				test_course(101, comp40, "B", false),
+			},
+			want: map[string]int64{"21": 100},
+		},
+		{
+			name:     "credits rule sums credits and frees the rest",
+			template: test_template(1, credits),
+			taken: []*TakenCourse{
+				test_course(100, one_half, "A", false),
+				test_course(101, one, "A", false),
+				test_course(102, half, "A", false),
+			},
+			want: map[string]int64{"4.1": 100, "4.2": 101},
+		},
+		{
+			name:     "credits rule uses small courses when needed",
+			template: test_template(1, credits),
+			taken: []*TakenCourse{
+				test_course(100, half, "A", false),
+				test_course(101, other_half, "A", false),
+				test_course(102, one_half, "A", false),
+			},
+			want: map[string]int64{"4.1": 102, "4.2": 0, "4.3": 0},
+		},
+		{
+			name:     "courses freed from a credits rule fill other requirements",
+			template: test_template(1, credits, select_half),
+			taken: []*TakenCourse{
+				test_course(100, one_half, "A", false),
+				test_course(101, one, "A", false),
+				test_course(102, half, "A", false),
+				test_course(103, other_half, "A", false),
+			},
+			want: map[string]int64{"4.1": 100, "4.2": 101, "31": 103},
+		},
+	}
+
+	for _, c := range cases {
+		sat_map := c.sat_map
+		if sat_map == nil {
+			sat_map = make(SatisfactionMap)
+		}
+		assignment := assign_courses(c.template, c.taken, sat_map)
+		if len(assignment) != len(c.want) {
+			t.Errorf("%s: assigned %d slots, want %d", c.name, len(assignment), len(c.want))
+		}
+		for slot, course_id := range c.want {
+			course, assigned := assignment[slot]
+			if !assigned {
+				t.Errorf("%s: slot %s not assigned, want course %d", c.name, slot, course_id)
+			} else if course_id != 0 && course.Id != course_id {
+				t.Errorf("%s: slot %s assigned course %d, want %d", c.name, slot,
+					course.Id, course_id)
+			}
+		}
+	}
+}
+
+func TestAuditCreditsRule(t *testing.T) {
+	half, one := test_class(50, 0.5), test_class(51, 1)
+	credits := test_category_rule(4, RULE_CREDITS, half, one)
+	credits.Min_credits = sql.NullFloat64{Float64: 2, Valid: true}
+	template := test_template(1, credits)
+
+	cases := []struct {
+		name      string
+		taken     []*TakenCourse
+		completed float64
+		satisfied bool
+	}{
+		{"no courses", []*TakenCourse{}, 0, false},
+		{"half credit courses add up", []*TakenCourse{
+			test_course(100, half, "A", false),
+			test_course(101, half, "B", false),
+			test_course(102, one, "P", true),
+		}, 2, true},
+		{"one half credit course", []*TakenCourse{
+			test_course(100, half, "A", false),
+		}, 0.5, false},
+	}
+	for _, c := range cases {
+		result := AuditTemplate(template, c.taken, nil, make(SatisfactionMap))
+		requirement := result.Requirements[0]
+		if requirement.Completed != c.completed || requirement.Satisfied != c.satisfied {
+			t.Errorf("%s: completed %g satisfied %v, want %g %v", c.name,
+				requirement.Completed, requirement.Satisfied, c.completed, c.satisfied)
+		}
+	}
+}
@@ -0,0 +1,410 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"math"
+	"strconv"
+)
+
+/*
+ * Degree audit. Walks the DSCategory template of a degree sheet and decides
+ * which of its requirements are met by the courses the student has taken.
+ */
+
+// The audit status of a single template rule
+type AuditRequirement struct {
+	Requirement_id string
+	Rule_id        int64
+	Ruletype       int64
+	Name           string
+	Satisfied      bool
+	Satisfied_by   *TakenCourse
+	Planned_by     *PlannedClass
+	Courses        []*TakenCourse
+	Required       float64
+	Completed      float64
+	Missing        []string
+	Children       []*AuditRequirement
+}
+
+// The audit of a whole template
+type AuditResult struct {
+	Sheet_id           int64
+	Template_id        int64
+	Template_name      string
+	Satisfied          bool
+	Requirements       []*AuditRequirement
+	Unassigned_courses []*TakenCourse
+
+	// Problems with the template, e.g. diamond inheritance
+	Warnings []string `json:",omitempty"`
+}
+
+// A single course-sized hole in a template. Most rules are one slot, rules
+// that need several courses are split into one slot per course.
+type requirementSlot struct {
+	Id   string
+	Rule *DSCategoryRule
+
+	// Slots below a RULE_SELECT, which only need filling up to its count,
+	// and the slots of a credits rule beyond the fewest courses that could
+	// meet it
+	Optional bool
+}
+
+// Audit a degree sheet against the template it was created from
+func AuditDegreeSheet(db *sql.DB, sheet *DegreeSheet) (*AuditResult, error) {
+	template, err := GetDSCategoryById(db, sheet.Template_id)
+	if err != nil {
+		return nil, err
+	}
+	result := AuditTemplate(template, sheet.Taken_courses,
+		sheet.Planned_courses, sheet.Dropped_courses)
+	result.Sheet_id = sheet.Id
+	return result, nil
+}
+
+// Audit a set of taken and planned courses against a template. Entries in the
+// satisfaction map are honoured where the mapped course is eligible for the
+// requirement, the remaining requirements are filled from unused courses.
+func AuditTemplate(template *DSCategory, taken []*TakenCourse,
+	planned []*PlannedClass, sat_map SatisfactionMap) *AuditResult {
+	assignment := assign_courses(template, taken, sat_map)
+
+	result := new(AuditResult)
+	result.Template_id = template.Id
+	result.Template_name = template.Name
+	result.Warnings = template.Warnings
+	result.Requirements = audit_category(template, assignment, planned,
+		make(map[int64]bool))
+
+	result.Satisfied = true
+	for _, requirement := range result.Requirements {
+		if !requirement.Satisfied {
+			result.Satisfied = false
+		}
+	}
+
+	used := make(map[int64]bool)
+	for _, course := range assignment {
+		used[course.Id] = true
+	}
+	result.Unassigned_courses = make([]*TakenCourse, 0)
+	for _, course := range taken {
+		if !used[course.Id] {
+			result.Unassigned_courses = append(result.Unassigned_courses, course)
+		}
+	}
+	return result
+}
+
+// The key used for a rule in a SatisfactionMap
+func requirement_id(rule *DSCategoryRule) string {
+	return strconv.FormatInt(rule.Id, 10)
+}
+
+// The key used for one course of a multi-course rule, e.g. 2140.3
+func requirement_slot_id(rule *DSCategoryRule, slot int) string {
+	return fmt.Sprintf("%d.%d", rule.Id, slot)
+}
+
+// The number of courses a multi-course rule is split into
+func rule_slot_count(rule *DSCategoryRule) int {
+	if rule.Ruletype == RULE_COUNT {
+		return int(rule.Min_count.Int64)
+	} else if rule.Ruletype == RULE_CREDITS {
+		_, slots := credit_rule_slots(rule)
+		return slots
+	}
+	return 1
+}
+
+// The number of courses a credits rule needs at least, if they are its
+// classes worth the most credits, and at most, if they are the ones worth the
+// least. Only the first of the slots must be filled, the rest take whatever
+// courses are left over until the credits are met.
+func credit_rule_slots(rule *DSCategoryRule) (int, int) {
+	most, least := 0.0, 0.0
+	if rule.class_category != nil {
+		for _, class := range rule.class_category.Classes {
+			credits := class_credits(class)
+			if credits <= 0 {
+				continue
+			}
+			if credits > most {
+				most = credits
+			}
+			if least == 0 || credits < least {
+				least = credits
+			}
+		}
+	}
+	if most == 0 {
+		most, least = 1, 1
+	}
+	return int(math.Ceil(rule.Min_credits.Float64 / most)),
+		int(math.Ceil(rule.Min_credits.Float64 / least))
+}
+
+// Get the slots of a template that are satisfied directly by a course,
+// descending into inherited templates. A template inherited through more than
+// one path only contributes its slots once.
+func template_slots(template *DSCategory) []*requirementSlot {
+	return append_template_slots(make([]*requirementSlot, 0), template, false,
+		make(map[int64]bool))
+}
+
+func append_template_slots(slots []*requirementSlot, template *DSCategory,
+	optional bool, visited map[int64]bool) []*requirementSlot {
+	if visited[template.Id] {
+		return slots
+	}
+	visited[template.Id] = true
+	for _, rule := range template.Rules {
+		if rule.Ruletype == RULE_INHERIT {
+			slots = append_template_slots(slots, rule.inherited, optional, visited)
+		} else if rule.Ruletype == RULE_SELECT {
+			slots = append_template_slots(slots, rule.inherited, true, visited)
+		} else if rule.Ruletype == RULE_COUNT || rule.Ruletype == RULE_CREDITS {
+			required := rule_slot_count(rule)
+			if rule.Ruletype == RULE_CREDITS {
+				required, _ = credit_rule_slots(rule)
+			}
+			for i := 1; i <= rule_slot_count(rule); i++ {
+				slots = append(slots, &requirementSlot{
+					Id:       requirement_slot_id(rule, i),
+					Rule:     rule,
+					Optional: optional || i > required,
+				})
+			}
+		} else {
+			slots = append(slots, &requirementSlot{
+				Id:       requirement_id(rule),
+				Rule:     rule,
+				Optional: optional,
+			})
+		}
+	}
+	return slots
+}
+
+// Check whether a class can be counted towards a rule
+func rule_matches_class(rule *DSCategoryRule, class_id int64) bool {
+	if rule.Ruletype == RULE_CLASS {
+		return rule.Class_id.Int64 == class_id
+	} else if rule.Ruletype == RULE_CATEGORY || rule.Ruletype == RULE_COUNT ||
+		rule.Ruletype == RULE_CREDITS {
+		return class_category_contains(rule.class_category, class_id)
+	}
+	return false
+}
+
+// Check whether a taken course can be counted towards a rule
+func rule_accepts_course(rule *DSCategoryRule, course *TakenCourse) bool {
+	return course_eligibility_error(rule, course) == ""
+}
+
+// Explain why a taken course cannot be counted towards a rule. Returns an
+// empty string if the course is eligible.
+func course_eligibility_error(rule *DSCategoryRule, course *TakenCourse) string {
+	if !rule_matches_class(rule, course.Class_id) {
+		return fmt.Sprintf("Class #%d does not match %s", course.Class_id,
+			rule_name(rule))
+	}
+	if course.Passfail && !rule.Passfail_allowed {
+		return fmt.Sprintf("Pass/fail courses cannot be counted towards %s",
+			rule_name(rule))
+	}
+	grade, grade_known := ParseGrade(course.Grade)
+	if grade_known && !grade.Passing {
+		return fmt.Sprintf("A grade of %s does not count towards %s",
+			grade.Letter, rule_name(rule))
+	}
+	if rule.Min_grade.Valid {
+		minimum, _ := ParseGrade(rule.Min_grade.String)
+		if !grade_known || !GradeAtLeast(grade, minimum) {
+			return fmt.Sprintf("A grade of %s or better is needed for %s",
+				minimum.Letter, rule_name(rule))
+		}
+	}
+	return ""
+}
+
+func class_category_contains(category *ClassCategory, class_id int64) bool {
+	for _, class := range category.Classes {
+		if class.Id == class_id {
+			return true
+		}
+	}
+	return false
+}
+
+// The number of credits a course is worth. Variable credit courses count
+// their minimum.
+func class_credits(class *Class) float64 {
+	return class.Credits
+}
+
+// Credit totals of a degree sheet
+type CreditTotals struct {
+	// Courses passed
+	Earned float64
+	// Courses without a grade yet
+	In_progress float64
+	Planned     float64
+}
+
+// Whether a taken course has been passed, or is still in progress without a
+// grade. Failed and withdrawn courses have to be taken again.
+func course_passed_or_in_progress(course *TakenCourse) bool {
+	grade, grade_known := ParseGrade(course.Grade)
+	return !grade_known || grade.Passing
+}
+
+func sheet_credit_totals(sheet *DegreeSheet) *CreditTotals {
+	totals := new(CreditTotals)
+	for _, course := range sheet.Taken_courses {
+		if course.Class == nil {
+			continue
+		}
+		grade, grade_known := ParseGrade(course.Grade)
+		if !grade_known {
+			totals.In_progress += class_credits(course.Class)
+		} else if grade.Passing {
+			totals.Earned += class_credits(course.Class)
+		}
+	}
+	for _, planned_class := range sheet.Planned_courses {
+		if planned_class.Class != nil {
+			totals.Planned += class_credits(planned_class.Class)
+		}
+	}
+	return totals
+}
+
+// Build the audit tree for the rules of a template
+func audit_category(category *DSCategory, assignment map[string]*TakenCourse,
+	planned []*PlannedClass, planned_used map[int64]bool) []*AuditRequirement {
+	requirements := make([]*AuditRequirement, 0)
+	for _, rule := range category.Rules {
+		requirements = append(requirements,
+			audit_rule(rule, assignment, planned, planned_used))
+	}
+	return requirements
+}
+
+func audit_rule(rule *DSCategoryRule, assignment map[string]*TakenCourse,
+	planned []*PlannedClass, planned_used map[int64]bool) *AuditRequirement {
+	requirement := new(AuditRequirement)
+	requirement.Requirement_id = requirement_id(rule)
+	requirement.Rule_id = rule.Id
+	requirement.Ruletype = rule.Ruletype
+	requirement.Name = rule_name(rule)
+	requirement.Courses = make([]*TakenCourse, 0)
+	requirement.Missing = make([]string, 0)
+	requirement.Children = make([]*AuditRequirement, 0)
+
+	if rule.Ruletype == RULE_INHERIT || rule.Ruletype == RULE_SELECT {
+		requirement.Children = audit_category(rule.inherited, assignment,
+			planned, planned_used)
+		missing := make([]string, 0)
+		for _, child := range requirement.Children {
+			requirement.Required++
+			if child.Satisfied {
+				requirement.Completed++
+			} else {
+				missing = append(missing, child.Missing...)
+			}
+		}
+		if rule.Ruletype == RULE_SELECT {
+			// Only the count matters, not which of the children are met
+			requirement.Required = float64(rule.Min_count.Int64)
+			if requirement.Completed < requirement.Required {
+				requirement.Missing = append(requirement.Missing,
+					fmt.Sprintf("%g more from %s",
+						requirement.Required-requirement.Completed,
+						requirement.Name))
+			}
+		} else {
+			requirement.Missing = missing
+		}
+		requirement.Satisfied = requirement.Completed >= requirement.Required
+		return requirement
+	}
+
+	if rule.Ruletype == RULE_COUNT || rule.Ruletype == RULE_CREDITS {
+		unit := "courses"
+		if rule.Ruletype == RULE_COUNT {
+			requirement.Required = float64(rule.Min_count.Int64)
+		} else {
+			requirement.Required = rule.Min_credits.Float64
+			unit = "credits"
+		}
+		for i := 1; i <= rule_slot_count(rule); i++ {
+			course, assigned := assignment[requirement_slot_id(rule, i)]
+			if !assigned {
+				continue
+			}
+			requirement.Courses = append(requirement.Courses, course)
+			if rule.Ruletype == RULE_COUNT {
+				requirement.Completed++
+			} else if course.Class != nil {
+				requirement.Completed += class_credits(course.Class)
+			}
+		}
+		requirement.Satisfied = requirement.Completed >= requirement.Required
+		if !requirement.Satisfied {
+			requirement.Missing = append(requirement.Missing,
+				fmt.Sprintf("%g more %s from %s",
+					requirement.Required-requirement.Completed, unit,
+					requirement.Name))
+			requirement.Planned_by = find_planned_class(rule, planned, planned_used)
+		}
+		return requirement
+	}
+
+	requirement.Required = 1
+	if course, assigned := assignment[requirement.Requirement_id]; assigned {
+		requirement.Satisfied = true
+		requirement.Satisfied_by = course
+		requirement.Courses = append(requirement.Courses, course)
+		requirement.Completed = 1
+		return requirement
+	}
+
+	requirement.Missing = append(requirement.Missing, requirement.Name)
+	requirement.Planned_by = find_planned_class(rule, planned, planned_used)
+	return requirement
+}
+
+// Find a planned class that has not been used yet and would satisfy a rule
+func find_planned_class(rule *DSCategoryRule, planned []*PlannedClass,
+	planned_used map[int64]bool) *PlannedClass {
+	for _, planned_class := range planned {
+		if !planned_used[planned_class.Id] &&
+			rule_matches_class(rule, planned_class.Class_id) {
+			planned_used[planned_class.Id] = true
+			return planned_class
+		}
+	}
+	return nil
+}
+
+// Human readable description of what a rule asks for
+func rule_name(rule *DSCategoryRule) string {
+	if rule.Ruletype == RULE_CLASS {
+		return class_name(rule.class)
+	} else if rule.Ruletype == RULE_CATEGORY || rule.Ruletype == RULE_COUNT ||
+		rule.Ruletype == RULE_CREDITS {
+		return rule.class_category.Name
+	} else if rule.Ruletype == RULE_INHERIT || rule.Ruletype == RULE_SELECT {
+		return rule.inherited.Name
+	}
+	return fmt.Sprintf("Rule #%d", rule.Id)
+}
+
+// Short name for a class, e.g. COMP 15
+func class_name(class *Class) string {
+	return fmt.Sprintf("%s %d", class.Subject_callsign, class.Course_number)
+}
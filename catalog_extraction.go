@@ -0,0 +1,526 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+/*
+ * Offline extraction of structured catalog data from class descriptions.
+ * Descriptions mention prerequisites ("Prerequisite: MATH 32 or 34.") and
+ * renumbered classes ("(Formerly MATH 5)"). Run with -extract-requisites to
+ * scan every description and store proposals, which an editor then accepts or
+ * rejects through /class.
+ */
+
+const PROPOSAL_REQUISITES = "requisites"
+const PROPOSAL_FORMER_NUMBER = "former_number"
+
+const PROPOSAL_PENDING = "pending"
+const PROPOSAL_ACCEPTED = "accepted"
+const PROPOSAL_REJECTED = "rejected"
+
+type CatalogProposal struct {
+	Id          int64
+	Class_id    int64
+	Kind        string
+	Source_text string
+	// Requisites proposals only
+	Requisites *RequisiteNode
+	// Former number proposals only
+	Former_subject sql.NullString
+	Former_number  sql.NullInt64
+	// Parts of the source text the parser could not make sense of
+	Notes  []string
+	Status string
+}
+
+// The parts of a requisite clause: "and", "or", list separators and class
+// references like "MATH 32", "COMP-0015" or "Spanish 004". The subject may be
+// left out in lists such as "MATH 32 or 34".
+var requisite_token_pattern = regexp.MustCompile(
+	`\b((?i:and|or))\b|([,/])|\b(?:([A-Z]{2,5}|[A-Z][a-z]+)[\s-]*)?0*([0-9]{1,4})\b`)
+
+// The lower case word following a class reference, if any
+var next_word_pattern = regexp.MustCompile(`^\s+([a-z]+)\b`)
+
+// The catalog mostly words these as "Recommendations: ..."
+var requisite_section_pattern = regexp.MustCompile(
+	`(?i)\b(prerequisites?|corequisites?|recommendations?)\s*:\s*([^.\r\n]*)`)
+
+var former_number_pattern = regexp.MustCompile(`\(Formerly ([A-Z]{2,5})[\s-]*0*([0-9]{1,4})\)`)
+
+var minimum_grade_pattern = regexp.MustCompile(
+	`(?i)(?:with )?(?:a |minimum )?grade of ([A-F][+-]?) or (?:better|higher|above)`)
+
+var consent_pattern = regexp.MustCompile(`(?i)\b(consent|permission)\b`)
+
+// "..., or consent of instructor", which should not make the classes before
+// it alternatives of each other
+var consent_alternative_pattern = regexp.MustCompile(`(?i),?\s*\bor\b[^,;]*\b(consent|permission)\b.*$`)
+
+// Scan all class descriptions and replace the pending proposals with new
+// ones. Text that already led to an accepted or rejected proposal is not
+// proposed again. Returns the number of proposals made.
+func ExtractCatalogProposals(db *sql.DB) (int, error) {
+	references, err := get_catalog_references(db)
+	if err != nil {
+		return 0, err
+	}
+	reviewed, err := get_reviewed_proposal_text(db)
+	if err != nil {
+		return 0, err
+	}
+
+	rows, err := db.Query("SELECT id, description FROM class ORDER BY id")
+	if err != nil {
+		return 0, err
+	}
+	proposals := make([]*CatalogProposal, 0)
+	for rows.Next() {
+		var class_id int64
+		var description string
+		if err := rows.Scan(&class_id, &description); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		for _, proposal := range parse_class_description(class_id, description, references) {
+			if !reviewed[proposal_review_key(proposal)] {
+				proposals = append(proposals, proposal)
+			}
+		}
+	}
+	rows.Close()
+
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	_, err = tx.Exec("DELETE FROM catalog_proposal WHERE status = ?", PROPOSAL_PENDING)
+	if err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+	for _, proposal := range proposals {
+		if err = insert_catalog_proposal(tx, proposal); err != nil {
+			tx.Rollback()
+			return 0, err
+		}
+	}
+	return len(proposals), tx.Commit()
+}
+
+// The classes and subjects a description may refer to
+type catalogReferences struct {
+	// Class IDs by "CALLSIGN number"
+	classes map[string]int64
+	// Subject callsigns by callsign and by upper case name, e.g. "SPANISH"
+	subjects map[string]string
+}
+
+func get_catalog_references(db *sql.DB) (*catalogReferences, error) {
+	references := &catalogReferences{
+		classes:  make(map[string]int64),
+		subjects: make(map[string]string),
+	}
+
+	rows, err := db.Query("SELECT callsign, description FROM subject")
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var callsign, description string
+		if err := rows.Scan(&callsign, &description); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		callsign = strings.ToUpper(callsign)
+		references.subjects[callsign] = callsign
+		references.subjects[strings.ToUpper(description)] = callsign
+	}
+	rows.Close()
+
+	rows, err = db.Query(`SELECT class.id, subject.callsign, class.course_number
+		FROM class, subject WHERE class.subject = subject.id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id, number int64
+		var callsign string
+		if err := rows.Scan(&id, &callsign, &number); err != nil {
+			return nil, err
+		}
+		references.classes[fmt.Sprintf("%s %d", strings.ToUpper(callsign), number)] = id
+	}
+	return references, rows.Err()
+}
+
+func get_reviewed_proposal_text(db *sql.DB) (map[string]bool, error) {
+	rows, err := db.Query(`SELECT class_id, kind, source_text FROM catalog_proposal
+		WHERE status != ?`, PROPOSAL_PENDING)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	reviewed := make(map[string]bool)
+	for rows.Next() {
+		proposal := new(CatalogProposal)
+		if err := rows.Scan(&proposal.Class_id, &proposal.Kind,
+			&proposal.Source_text); err != nil {
+			return nil, err
+		}
+		reviewed[proposal_review_key(proposal)] = true
+	}
+	return reviewed, rows.Err()
+}
+
+func proposal_review_key(proposal *CatalogProposal) string {
+	return fmt.Sprintf("%d:%s:%s", proposal.Class_id, proposal.Kind, proposal.Source_text)
+}
+
+// Find the proposals in the description of a class
+func parse_class_description(class_id int64, description string,
+	references *catalogReferences) []*CatalogProposal {
+	proposals := make([]*CatalogProposal, 0)
+
+	for _, match := range former_number_pattern.FindAllStringSubmatch(description, -1) {
+		number, _ := strconv.ParseInt(match[2], 10, 64)
+		proposals = append(proposals, &CatalogProposal{
+			Class_id:       class_id,
+			Kind:           PROPOSAL_FORMER_NUMBER,
+			Source_text:    match[0],
+			Former_subject: sql.NullString{String: match[1], Valid: true},
+			Former_number:  sql.NullInt64{Int64: number, Valid: true},
+			Notes:          make([]string, 0),
+			Status:         PROPOSAL_PENDING,
+		})
+	}
+
+	sections := requisite_section_pattern.FindAllStringSubmatch(description, -1)
+	if len(sections) == 0 {
+		return proposals
+	}
+	proposal := &CatalogProposal{
+		Class_id: class_id,
+		Kind:     PROPOSAL_REQUISITES,
+		Notes:    make([]string, 0),
+		Status:   PROPOSAL_PENDING,
+	}
+	root := &RequisiteNode{Node_type: REQUISITE_AND, Children: make([]*RequisiteNode, 0)}
+	source := make([]string, 0)
+	for _, section := range sections {
+		source = append(source, strings.TrimSpace(section[0]))
+		corequisite := strings.HasPrefix(strings.ToLower(section[1]), "co")
+		if strings.HasPrefix(strings.ToLower(section[1]), "rec") {
+			proposal.Notes = append(proposal.Notes, fmt.Sprintf(
+				"Only recommended, accepting makes it required: %s",
+				strings.TrimSpace(section[0])))
+		}
+		for _, clause := range strings.Split(section[2], ";") {
+			node, notes := parse_requisite_clause(clause, corequisite, references)
+			proposal.Notes = append(proposal.Notes, notes...)
+			if node != nil {
+				root.Children = append(root.Children, node)
+			}
+		}
+	}
+	proposal.Source_text = strings.Join(source, ". ")
+	if len(root.Children) == 0 {
+		// Nothing to propose. Accepting it would clear the class's requisites.
+		return proposals
+	} else if len(root.Children) == 1 {
+		proposal.Requisites = root.Children[0]
+	} else {
+		proposal.Requisites = root
+	}
+	return append(proposals, proposal)
+}
+
+// Parse one clause of a requisite section, e.g. "MATH 32 or 34 with a grade
+// of C or better". "or" binds tighter than "and", so "COMP 15 and MATH 22 or
+// 61" needs COMP 15 and one of the MATH classes. Commas take the meaning of
+// the next "and" or "or". Clauses mixing both are noted for review.
+func parse_requisite_clause(clause string, corequisite bool,
+	references *catalogReferences) (*RequisiteNode, []string) {
+	notes := make([]string, 0)
+	min_grade := sql.NullString{}
+	if match := minimum_grade_pattern.FindStringSubmatch(clause); match != nil {
+		if _, known := ParseGrade(match[1]); known {
+			min_grade = sql.NullString{String: strings.ToUpper(match[1]), Valid: true}
+		}
+		clause = strings.Replace(clause, match[0], "", 1)
+	}
+	if consent_pattern.MatchString(clause) {
+		notes = append(notes, fmt.Sprintf("Instructor consent is not recorded: %s",
+			strings.TrimSpace(clause)))
+		clause = consent_alternative_pattern.ReplaceAllString(clause, "")
+	}
+
+	// Read the clause as classes with the separator before each one
+	type clauseClass struct {
+		node      *RequisiteNode
+		separator string
+	}
+	parsed := make([]clauseClass, 0)
+	separators := make([]string, 0)
+	subject := ""
+	separator := ""
+	end := 0
+	for _, match := range requisite_token_pattern.FindAllStringSubmatchIndex(clause, -1) {
+		adjacent := strings.TrimSpace(clause[end:match[0]]) == ""
+		end = match[1]
+		if match[2] >= 0 || match[4] >= 0 {
+			if !adjacent {
+				separator = ""
+			}
+			word := strings.ToLower(clause[match[0]:match[1]])
+			if separator == "" || separator == "," {
+				separator = word
+			}
+			separators = append(separators, word)
+			continue
+		}
+
+		// A bare number only takes the subject of the class before it when
+		// it directly follows a separator, as in "MATH 32 or 34", and isn't
+		// counting something, as in "and 2 semesters of calculus"
+		if match[6] >= 0 {
+			subject = references.subjects[strings.ToUpper(clause[match[6]:match[7]])]
+		} else if separator == "" || !adjacent {
+			subject = ""
+		} else if word := next_word_pattern.FindStringSubmatch(clause[match[1]:]); word != nil &&
+			word[1] != REQUISITE_AND && word[1] != REQUISITE_OR {
+			subject = ""
+		}
+		if subject == "" {
+			separator = ""
+			continue
+		}
+		number, _ := strconv.ParseInt(clause[match[8]:match[9]], 10, 64)
+		name := fmt.Sprintf("%s %d", subject, number)
+		class_id, known := references.classes[name]
+		if !known {
+			notes = append(notes, fmt.Sprintf("Unknown class %s", name))
+			separator = ""
+			continue
+		}
+		parsed = append(parsed, clauseClass{
+			node: &RequisiteNode{
+				Node_type:   REQUISITE_CLASS,
+				Class_id:    sql.NullInt64{Int64: class_id, Valid: true},
+				Class_name:  name,
+				Min_grade:   min_grade,
+				Corequisite: corequisite,
+				Children:    make([]*RequisiteNode, 0),
+			},
+			separator: separator,
+		})
+		separator = ""
+	}
+	if len(parsed) == 0 {
+		return nil, notes
+	}
+
+	// Commas mean whatever the next word separating classes does, "and" if
+	// there is none
+	for i := range parsed {
+		if parsed[i].separator != "," {
+			continue
+		}
+		parsed[i].separator = REQUISITE_AND
+		for _, next := range parsed[i+1:] {
+			if next.separator == REQUISITE_AND || next.separator == REQUISITE_OR {
+				parsed[i].separator = next.separator
+				break
+			}
+		}
+	}
+
+	// Group the classes joined by "or", then require every group
+	groups := make([]*RequisiteNode, 0)
+	has_and, has_or := false, false
+	for i, class := range parsed {
+		if i > 0 && class.separator == REQUISITE_OR {
+			has_or = true
+			group := groups[len(groups)-1]
+			if group.Node_type != REQUISITE_OR {
+				group = &RequisiteNode{Node_type: REQUISITE_OR,
+					Children: []*RequisiteNode{group}}
+				groups[len(groups)-1] = group
+			}
+			group.Children = append(group.Children, class.node)
+			continue
+		}
+		if i > 0 {
+			has_and = true
+		}
+		groups = append(groups, class.node)
+	}
+	if has_and && has_or {
+		notes = append(notes, fmt.Sprintf("Check how \"and\" and \"or\" are grouped: %s",
+			strings.TrimSpace(clause)))
+	}
+	if len(groups) == 1 {
+		return groups[0], notes
+	}
+	return &RequisiteNode{Node_type: REQUISITE_AND, Children: groups}, notes
+}
+
+func insert_catalog_proposal(tx *sql.Tx, proposal *CatalogProposal) error {
+	var requisites sql.NullString
+	if proposal.Requisites != nil {
+		encoded, err := json.Marshal(proposal.Requisites)
+		if err != nil {
+			return err
+		}
+		requisites = sql.NullString{String: string(encoded), Valid: true}
+	}
+	_, err := tx.Exec(`INSERT INTO catalog_proposal
+		(class_id, kind, source_text, requisites, former_subject, former_number,
+		notes, status) VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+		proposal.Class_id, proposal.Kind, proposal.Source_text, requisites,
+		proposal.Former_subject, proposal.Former_number,
+		strings.Join(proposal.Notes, "\n"), proposal.Status)
+	return err
+}
+
+// Get the proposals with a status, e.g. the pending ones
+func GetCatalogProposals(db sqlQueryer, status string) ([]*CatalogProposal, error) {
+	rows, err := db.Query(`SELECT id, class_id, kind, source_text, requisites,
+		former_subject, former_number, notes, status FROM catalog_proposal
+		WHERE status = ? ORDER BY class_id, id`, status)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	proposals := make([]*CatalogProposal, 0)
+	for rows.Next() {
+		proposal, err := scan_catalog_proposal(rows)
+		if err != nil {
+			return nil, err
+		}
+		proposals = append(proposals, proposal)
+	}
+	return proposals, rows.Err()
+}
+
+func scan_catalog_proposal(row interface {
+	Scan(dest ...interface{}) error
+}) (*CatalogProposal, error) {
+	proposal := new(CatalogProposal)
+	var requisites sql.NullString
+	var notes string
+	if err := row.Scan(
+		&proposal.Id,
+		&proposal.Class_id,
+		&proposal.Kind,
+		&proposal.Source_text,
+		&requisites,
+		&proposal.Former_subject,
+		&proposal.Former_number,
+		&notes,
+		&proposal.Status); err != nil {
+		return nil, err
+	}
+	if requisites.Valid {
+		proposal.Requisites = new(RequisiteNode)
+		if err := json.Unmarshal([]byte(requisites.String), proposal.Requisites); err != nil {
+			return nil, err
+		}
+	}
+	proposal.Notes = make([]string, 0)
+	if notes != "" {
+		proposal.Notes = strings.Split(notes, "\n")
+	}
+	return proposal, nil
+}
+
+// A proposal that has already been accepted or rejected
+type ProposalReviewedError struct {
+	Id     int64
+	Status string
+}
+
+func (e *ProposalReviewedError) Error() string {
+	return fmt.Sprintf("Proposal #%d has already been %s", e.Id, e.Status)
+}
+
+// A requisites proposal without any classes, which can't be accepted
+type ProposalEmptyError struct {
+	Id int64
+}
+
+func (e *ProposalEmptyError) Error() string {
+	return fmt.Sprintf("Proposal #%d has no requisites to accept", e.Id)
+}
+
+// Accept or reject a pending proposal. Accepting a requisites proposal
+// replaces the requisites of the class, so proposals without any requisites
+// can only be rejected.
+func ReviewCatalogProposal(db *sql.DB, proposal_id int64, accept bool) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	proposal, err := scan_catalog_proposal(tx.QueryRow(`SELECT id, class_id, kind,
+		source_text, requisites, former_subject, former_number, notes, status
+		FROM catalog_proposal WHERE id = ?`, proposal_id))
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	if proposal.Status != PROPOSAL_PENDING {
+		tx.Rollback()
+		return &ProposalReviewedError{Id: proposal_id, Status: proposal.Status}
+	}
+
+	if accept && proposal.Kind == PROPOSAL_REQUISITES && proposal.Requisites == nil {
+		tx.Rollback()
+		return &ProposalEmptyError{Id: proposal_id}
+	}
+
+	status := PROPOSAL_REJECTED
+	if accept {
+		status = PROPOSAL_ACCEPTED
+		if proposal.Kind == PROPOSAL_REQUISITES {
+			err = SetRequisitesForClass(tx, proposal.Class_id, proposal.Requisites)
+		} else if proposal.Kind == PROPOSAL_FORMER_NUMBER {
+			_, err = tx.Exec(`INSERT INTO class_former_number
+				(class_id, subject, course_number) VALUES (?, ?, ?)`,
+				proposal.Class_id, proposal.Former_subject, proposal.Former_number)
+		}
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	_, err = tx.Exec("UPDATE catalog_proposal SET status = ? WHERE id = ?",
+		status, proposal_id)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// Entry point of -extract-requisites
+func run_catalog_extraction(server_config *Config) {
+	db, err := sql.Open("mysql", server_config.GetSqlURI())
+	if err != nil {
+		log.Fatal("Extraction: Failed to open database: ", err)
+	}
+	count, err := ExtractCatalogProposals(db)
+	if err != nil {
+		log.Fatal("Extraction: ", err)
+	}
+	log.Println("Extraction: made", count, "proposals for review")
+}
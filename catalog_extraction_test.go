@@ -0,0 +1,163 @@
+package main
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+var test_references = &catalogReferences{
+	classes: map[string]int64{
+		"COMP 11": 1, "COMP 15": 2, "MATH 22": 3, "MATH 32": 4, "MATH 34": 5,
+		"MATH 61": 6, "ENG 1": 7, "ENG 3": 8, "SPN 4": 9, "FR 1": 10,
+	},
+	subjects: map[string]string{
+		"COMP": "COMP", "MATH": "MATH", "ENG": "ENG", "SPN": "SPN", "FR": "FR",
+		"COMPUTER SCIENCE": "COMP", "ENGLISH": "ENG", "SPANISH": "SPN", "FRENCH": "FR",
+	},
+}
+
+// A requisite tree written out, e.g. and(COMP 15, or(MATH 22, MATH 61))
+func requisite_string(node *RequisiteNode) string {
+	if node == nil {
+		return ""
+	}
+	if node.Node_type == REQUISITE_CLASS {
+		name := node.Class_name
+		if node.Min_grade.Valid {
+			name += ">=" + node.Min_grade.String
+		}
+		if node.Corequisite {
+			name += " (co)"
+		}
+		return name
+	}
+	children := make([]string, 0)
+	for _, child := range node.Children {
+		children = append(children, requisite_string(child))
+	}
+	return node.Node_type + "(" + strings.Join(children, ", ") + ")"
+}
+
+func TestParseRequisiteClause(t *testing.T) {
+	cases := []struct {
+		clause string
+		want   string
+		// Number of notes for the reviewer
+		notes int
+	}{
+		{"COMP 15", "COMP 15", 0},
+		{"COMP 11 and COMP 15", "and(COMP 11, COMP 15)", 0},
+		{"MATH 32 or 34", "or(MATH 32, MATH 34)", 0},
+		{"MATH 32, 34, or 22", "or(MATH 32, MATH 34, MATH 22)", 0},
+		{"COMP 11, COMP 15 and MATH 22", "and(COMP 11, COMP 15, MATH 22)", 0},
+		{"COMP 15 and MATH 22 or 61", "and(COMP 15, or(MATH 22, MATH 61))", 1},
+		{"MATH 32 or 34 with a grade of C or better", "or(MATH 32>=C, MATH 34>=C)", 0},
+		{"COMP-0015", "COMP 15", 0},
+		{"Spanish 004 or consent", "SPN 4", 1},
+		{"French 001 or consent", "FR 1", 1},
+		{"Either ENG 1 or ENG 3, or advanced placement standing of 4", "or(ENG 1, ENG 3)", 0},
+		{"COMP 15 and 2 semesters of calculus", "COMP 15", 0},
+		{"High school geometry and algebra", "", 0},
+		{"Calculus 2", "", 0},
+		{"COMP 99", "", 1},
+	}
+	for _, c := range cases {
+		node, notes := parse_requisite_clause(c.clause, false, test_references)
+		if got := requisite_string(node); got != c.want {
+			t.Errorf("%q: got %q, want %q", c.clause, got, c.want)
+		}
+		if len(notes) != c.notes {
+			t.Errorf("%q: got notes %q, want %d", c.clause, notes, c.notes)
+		}
+	}
+}
+
+func TestParseClassDescription(t *testing.T) {
+	cases := []struct {
+		description string
+		requisites  string
+		former      string
+		// Whether a reviewer is told the requisites are only recommended
+		recommended bool
+	}{
+		{"Intro to stuff. Recommendations: Spanish 004 or consent.", "SPN 4", "", true},
+		// Nothing is proposed when no classes are found
+		{"Recommendations:  High school geometry and algebra.", "", "", false},
+		{"Prerequisite: COMP 11; MATH 32 or 34. Corequisite: MATH 22.",
+			"and(COMP 11, or(MATH 32, MATH 34), MATH 22 (co))", "", false},
+		{"Data structures. (Formerly COMP 15) Prerequisites: COMP 11.",
+			"COMP 11", "COMP 15", false},
+		{"No requisites at all.", "", "", false},
+	}
+	for _, c := range cases {
+		requisites, former, recommended := "", "", false
+		for _, proposal := range parse_class_description(1, c.description, test_references) {
+			if proposal.Kind == PROPOSAL_FORMER_NUMBER {
+				former = fmt.Sprintf("%s %d", proposal.Former_subject.String,
+					proposal.Former_number.Int64)
+				continue
+			}
+			requisites = requisite_string(proposal.Requisites)
+			for _, note := range proposal.Notes {
+				if strings.HasPrefix(note, "Only recommended") {
+					recommended = true
+				}
+			}
+		}
+		if requisites != c.requisites {
+			t.Errorf("%q: got requisites %q, want %q", c.description, requisites, c.requisites)
+		}
+		if former != c.former {
+			t.Errorf("%q: got former number %q, want %q", c.description, former, c.former)
+		}
+		if recommended != c.recommended {
+			t.Errorf("%q: got recommended %v, want %v", c.description, recommended, c.recommended)
+		}
+	}
+}
+
+func TestReviewCatalogProposal(t *testing.T) {
+	requisites, err := json.Marshal(&RequisiteNode{Node_type: REQUISITE_CLASS, Class_name: "COMP 11"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		name       string
+		requisites driver.Value
+		status     string
+		accept     bool
+		// Whether the class's requisites are replaced and the proposal updated
+		replaced bool
+		updated  bool
+	}{
+		{"accept", string(requisites), PROPOSAL_PENDING, true, true, true},
+		{"reject", string(requisites), PROPOSAL_PENDING, false, false, true},
+		{"accept without requisites", nil, PROPOSAL_PENDING, true, false, false},
+		{"reject without requisites", nil, PROPOSAL_PENDING, false, false, true},
+		{"accept reviewed", string(requisites), PROPOSAL_REJECTED, true, false, false},
+	}
+	for _, c := range cases {
+		db, fake := open_test_db(&testResult{pattern: "FROM catalog_proposal WHERE id", rows: [][]driver.Value{
+			{int64(1), int64(15), PROPOSAL_REQUISITES, "Prerequisite: COMP 11", c.requisites,
+				nil, nil, "", c.status},
+		}})
+		err := ReviewCatalogProposal(db, 1, c.accept)
+		if c.updated && err != nil {
+			t.Errorf("%s: %v", c.name, err)
+		} else if !c.updated && err == nil {
+			t.Errorf("%s: got no error", c.name)
+		}
+		if _, empty := err.(*ProposalEmptyError); empty != (c.accept && c.requisites == nil) {
+			t.Errorf("%s: got error %v", c.name, err)
+		}
+		if replaced := len(fake.ran("DELETE FROM class_requisite")) > 0; replaced != c.replaced {
+			t.Errorf("%s: requisites replaced %v, want %v", c.name, replaced, c.replaced)
+		}
+		if updated := len(fake.ran("UPDATE catalog_proposal")) > 0; updated != c.updated {
+			t.Errorf("%s: proposal updated %v, want %v", c.name, updated, c.updated)
+		}
+	}
+}
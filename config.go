@@ -48,6 +48,16 @@ type Config struct {
 		Password  string
 		QueueSize int
 	}
+
+	Templates struct {
+		// Usernames of the users allowed to edit degree templates
+		Editor []string
+	}
+
+	Catalog struct {
+		// Usernames of the users allowed to review catalog proposals
+		Editor []string
+	}
 }
 
 func (kc Config) GetSqlURI() string {
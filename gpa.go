@@ -0,0 +1,149 @@
+package main
+
+import (
+	"sort"
+)
+
+/*
+ * Grade point averages. Only letter graded courses count: pass/fail,
+ * withdrawn, incomplete and in progress courses are left out. Courses are
+ * weighted by their credits.
+ */
+
+type GradePointAverage struct {
+	Gpa            float64
+	Grade_points   float64
+	Graded_credits float64
+	Courses        int64
+}
+
+// The GPA of a term
+type TermGPA struct {
+	Year     int64
+	Semester int64
+	GradePointAverage
+}
+
+// The GPA of the courses counted towards an inherited template of a sheet
+type GroupGPA struct {
+	Requirement_id string
+	Name           string
+	GradePointAverage
+}
+
+type SheetGPA struct {
+	Sheet_id   int64
+	Cumulative GradePointAverage
+	Terms      []*TermGPA
+	// Courses counted towards the sheet's template
+	Major GradePointAverage
+	// Courses counted towards each sub-template, outermost first
+	Groups []*GroupGPA
+}
+
+// Compute the GPA of a set of courses
+func grade_point_average(courses []*TakenCourse) GradePointAverage {
+	var average GradePointAverage
+	for _, course := range courses {
+		if course.Passfail || course.Class == nil {
+			continue
+		}
+		grade, grade_known := ParseGrade(course.Grade)
+		if !grade_known || !grade.Graded {
+			continue
+		}
+		credits := class_credits(course.Class)
+		average.Grade_points += grade.Points * credits
+		average.Graded_credits += credits
+		average.Courses++
+	}
+	if average.Graded_credits > 0 {
+		average.Gpa = average.Grade_points / average.Graded_credits
+	}
+	return average
+}
+
+// Compute the cumulative, term, major and sub-template GPAs of a sheet. The
+// major and sub-template GPAs include the courses the audit counts towards
+// them, and every other graded attempt at those classes, so failed attempts
+// before a passing one still lower them.
+func SheetGradePointAverages(sheet *DegreeSheet, template *DSCategory) *SheetGPA {
+	gpa := new(SheetGPA)
+	gpa.Sheet_id = sheet.Id
+	gpa.Cumulative = grade_point_average(sheet.Taken_courses)
+
+	terms := make(map[int64][]*TakenCourse)
+	for _, course := range sheet.Taken_courses {
+		index := term_index(course.Year, course.Semester)
+		terms[index] = append(terms[index], course)
+	}
+	gpa.Terms = make([]*TermGPA, 0)
+	for _, courses := range terms {
+		gpa.Terms = append(gpa.Terms, &TermGPA{
+			Year:              courses[0].Year,
+			Semester:          courses[0].Semester,
+			GradePointAverage: grade_point_average(courses),
+		})
+	}
+	sort.Slice(gpa.Terms, func(i, j int) bool {
+		return term_index(gpa.Terms[i].Year, gpa.Terms[i].Semester) <
+			term_index(gpa.Terms[j].Year, gpa.Terms[j].Semester)
+	})
+
+	audit := AuditTemplate(template, sheet.Taken_courses, nil, sheet.Dropped_courses)
+	gpa.Major = grade_point_average(class_attempts(
+		requirement_courses(audit.Requirements), sheet.Taken_courses))
+	gpa.Groups = make([]*GroupGPA, 0)
+	var walk func(requirements []*AuditRequirement)
+	walk = func(requirements []*AuditRequirement) {
+		for _, requirement := range requirements {
+			if requirement.Ruletype != RULE_INHERIT && requirement.Ruletype != RULE_SELECT {
+				continue
+			}
+			gpa.Groups = append(gpa.Groups, &GroupGPA{
+				Requirement_id: requirement.Requirement_id,
+				Name:           requirement.Name,
+				GradePointAverage: grade_point_average(class_attempts(
+					requirement_courses(requirement.Children), sheet.Taken_courses)),
+			})
+			walk(requirement.Children)
+		}
+	}
+	walk(audit.Requirements)
+	return gpa
+}
+
+// The taken courses of the same classes as the counted courses
+func class_attempts(counted []*TakenCourse, taken []*TakenCourse) []*TakenCourse {
+	classes := make(map[int64]bool)
+	for _, course := range counted {
+		classes[course.Class_id] = true
+	}
+	courses := make([]*TakenCourse, 0)
+	for _, course := range taken {
+		if classes[course.Class_id] {
+			courses = append(courses, course)
+		}
+	}
+	return courses
+}
+
+// The distinct taken courses counted anywhere in an audit subtree
+func requirement_courses(requirements []*AuditRequirement) []*TakenCourse {
+	courses := make([]*TakenCourse, 0)
+	seen := make(map[int64]bool)
+	var walk func(requirements []*AuditRequirement)
+	walk = func(requirements []*AuditRequirement) {
+		for _, requirement := range requirements {
+			for _, course := range requirement.Courses {
+				if !seen[course.Id] {
+					seen[course.Id] = true
+					courses = append(courses, course)
+				}
+			}
+			walk(requirement.Children)
+		}
+	}
+	walk(requirements)
+	return courses
+}
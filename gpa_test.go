@@ -0,0 +1,78 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestGradePointAverage(t *testing.T) {
+	one, half := test_class(11, 1), test_class(15, 0.5)
+
+	cases := []struct {
+		name    string
+		courses []*TakenCourse
+		gpa     float64
+		credits float64
+	}{
+		{"no courses", []*TakenCourse{}, 0, 0},
+		{"weighted by credits", []*TakenCourse{
+			test_course(100, one, "A", false),
+			test_course(101, half, "C", false),
+		}, (4.0 + 2.0*0.5) / 1.5, 1.5},
+		{"failed courses count", []*TakenCourse{
+			test_course(100, one, "B", false),
+			test_course(101, one, "F", false),
+		}, 1.5, 2},
+		{"pass/fail, withdrawn and in progress courses are left out", []*TakenCourse{
+			test_course(100, one, "B", false),
+			test_course(101, one, "A", true),
+			test_course(102, one, "P", true),
+			test_course(103, one, "W", false),
+			test_course(104, one, "", false),
+		}, 3.0, 1},
+	}
+	for _, c := range cases {
+		average := grade_point_average(c.courses)
+		if average.Gpa != c.gpa || average.Graded_credits != c.credits {
+			t.Errorf("%s: got GPA %g over %g credits, want %g over %g", c.name,
+				average.Gpa, average.Graded_credits, c.gpa, c.credits)
+		}
+	}
+}
+
+func TestSheetGradePointAverages(t *testing.T) {
+	comp11, comp15, comp40 := test_class(11, 1), test_class(15, 1), test_class(40, 1)
+	math32 := test_class(32, 1)
+	minor := test_template(20, test_class_rule(21, comp15))
+	template := test_template(1,
+		test_category_rule(2, RULE_CATEGORY, comp11, comp40),
+		test_inherit_rule(3, minor))
+
+	retaken := test_course(101, comp15, "A", false)
+	retaken.Year = 2016
+	retaken.Semester = 1
+	sheet := &DegreeSheet{Id: 1, Taken_courses: []*TakenCourse{
+		test_course(100, comp15, "C", false),
+		retaken,
+		test_course(102, comp11, "B", false),
+		test_course(103, math32, "F", false),
+		// Matches rule 2, but the audit counts COMP 11 there
+		test_course(104, comp40, "A", false),
+	}}
+
+	gpa := SheetGradePointAverages(sheet, template)
+	if gpa.Cumulative.Gpa != 2.6 {
+		t.Errorf("cumulative GPA %g, want 2.6", gpa.Cumulative.Gpa)
+	}
+	if len(gpa.Terms) != 2 || gpa.Terms[0].Year != 2015 || gpa.Terms[1].Year != 2016 {
+		t.Errorf("got terms %+v, want Fall 2015 and Spring 2016", gpa.Terms)
+	}
+	// Every graded attempt at a counted class counts, not just the one the
+	// audit used, but classes the audit doesn't count are left out
+	if gpa.Major.Gpa != 3.0 || gpa.Major.Courses != 3 {
+		t.Errorf("major GPA %g over %d courses, want 3 over 3", gpa.Major.Gpa,
+			gpa.Major.Courses)
+	}
+	if len(gpa.Groups) != 1 || gpa.Groups[0].Gpa != 3.0 || gpa.Groups[0].Courses != 2 {
+		t.Errorf("got groups %+v, want one with GPA 3 over 2 courses", gpa.Groups)
+	}
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"strings"
+)
+
+/*
+ * Grade scale. TakenCourse.Grade is free text entered by the student, so
+ * grades are only interpreted when they appear in the scale below.
+ */
+
+type Grade struct {
+	Letter string
+	Points float64
+	// Whether the grade is included in GPA calculations
+	Graded bool
+	// Whether the course was completed and passed
+	Passing bool
+}
+
+// Known grades, best first. An A+ is deliberately worth the same 4.0 points
+// as an A, as the GPA scale tops out at 4.0. A minimum of A+ is therefore
+// met by an A too.
+var grade_scale = []*Grade{
+	{"A+", 4.0, true, true},
+	{"A", 4.0, true, true},
+	{"A-", 3.7, true, true},
+	{"B+", 3.3, true, true},
+	{"B", 3.0, true, true},
+	{"B-", 2.7, true, true},
+	{"C+", 2.3, true, true},
+	{"C", 2.0, true, true},
+	{"C-", 1.7, true, true},
+	{"D+", 1.3, true, true},
+	{"D", 1.0, true, true},
+	{"D-", 0.7, true, true},
+	{"F", 0.0, true, false},
+	// Pass/fail grades carry no points
+	{"P", 0.0, false, true},
+	{"NP", 0.0, false, false},
+	// Withdrawn and incomplete courses have not been completed
+	{"W", 0.0, false, false},
+	{"I", 0.0, false, false},
+}
+
+// Look up a grade in the grade scale. Returns false for grades that aren't
+// known, including the empty grade of a course that is still in progress.
+func ParseGrade(grade string) (*Grade, bool) {
+	grade = strings.ToUpper(strings.TrimSpace(grade))
+	for _, g := range grade_scale {
+		if g.Letter == grade {
+			return g, true
+		}
+	}
+	return nil, false
+}
+
+// Whether a grade is the same as or better than a minimum letter grade. Only
+// letter grades can meet a minimum, so a P never does.
+func GradeAtLeast(grade *Grade, minimum *Grade) bool {
+	if !grade.Graded || !minimum.Graded {
+		return false
+	}
+	return grade.Points >= minimum.Points
+}
@@ -29,11 +29,18 @@ var config_log_stderr bool
 const config_log_stderr_default = false
 const config_log_stderr_usage = "Log to stderr instead of the specified logfiles"
 
+// Propose prerequisites from class descriptions instead of serving
+var config_extract_requisites bool
+
+const config_extract_requisites_usage = "Propose class prerequisites and former numbers from the catalog descriptions, then exit"
+
 func init() {
 	flag.StringVar(&config_file, "config", config_file_default, config_file_usage)
 	flag.StringVar(&config_file, "c", config_file_default, config_file_usage+" (shorthand)")
 
 	flag.BoolVar(&config_log_stderr, "stderr", config_log_stderr_default, config_log_stderr_usage)
+
+	flag.BoolVar(&config_extract_requisites, "extract-requisites", false, config_extract_requisites_usage)
 }
 
 func init_server() {
@@ -69,6 +76,8 @@ func init_server() {
 	api_handler.AddServlet("/class", NewClassServlet(&server_config, session_manager))
 	api_handler.AddServlet("/review", NewReviewServlet(server_config, session_manager))
 	api_handler.AddServlet("/degreesheet", NewDegreeSheetServlet(server_config, session_manager))
+	api_handler.AddServlet("/template", NewTemplateServlet(&server_config, session_manager))
+	api_handler.AddServlet("/advisor", NewAdvisorServlet(&server_config, session_manager))
 
 	// Start listening to HTTP requests
 	if err := http_server.ListenAndServe(); err != nil {
@@ -93,6 +102,11 @@ func main() {
 	// Set config options that were loaded from CLI
 	server_config.Arguments.LogToStderr = config_log_stderr
 
+	if config_extract_requisites {
+		run_catalog_extraction(&server_config)
+		return
+	}
+
 	/*
 	 * Set up log facility
 	 */
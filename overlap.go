@@ -0,0 +1,169 @@
+package main
+
+import (
+	"database/sql"
+	"sort"
+)
+
+/*
+ * Limits on how many courses two templates may share, e.g. a major and a
+ * minor, and checking them across all of a user's degree sheets.
+ *
+ * The check is advisory. Each sheet is audited on its own, and the limits
+ * are only compared against the courses those audits happen to use; they do
+ * not steer the assignment. A pair can therefore be flagged even though
+ * another assignment of the same courses would share fewer, which the
+ * student can get by saving a satisfaction map that avoids the shared
+ * courses.
+ */
+
+// How many courses may count towards both of two templates. Zero forbids
+// sharing entirely.
+type OverlapPolicy struct {
+	Template_a int64
+	Template_b int64
+	Max_shared int64
+}
+
+// The courses two of a user's sheets both count
+type SheetOverlap struct {
+	Sheet_a        int64
+	Sheet_b        int64
+	Shared_courses []*TakenCourse
+	// Unset if the templates of the sheets have no overlap policy
+	Max_shared  sql.NullInt64
+	Over_shared bool
+}
+
+// Audits of all of a user's sheets, and where they overlap
+type CombinedAudit struct {
+	Audits   []*AuditResult
+	Overlaps []*SheetOverlap
+	// Set if any pair of sheets shares more courses than allowed by the
+	// assignments the audits chose, which may be avoidable
+	Over_shared bool
+}
+
+// Policies are stored once per pair, with the lower template ID first
+func overlap_pair(template_a int64, template_b int64) (int64, int64) {
+	if template_b < template_a {
+		return template_b, template_a
+	}
+	return template_a, template_b
+}
+
+func GetOverlapPolicies(db sqlQueryer) (map[[2]int64]*OverlapPolicy, error) {
+	rows, err := db.Query(
+		"SELECT template_a, template_b, max_shared FROM ds_category_overlap")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	policies := make(map[[2]int64]*OverlapPolicy)
+	for rows.Next() {
+		policy := new(OverlapPolicy)
+		if err := rows.Scan(
+			&policy.Template_a,
+			&policy.Template_b,
+			&policy.Max_shared); err != nil {
+			return nil, err
+		}
+		policies[[2]int64{policy.Template_a, policy.Template_b}] = policy
+	}
+	return policies, rows.Err()
+}
+
+// Set the overlap policy of a pair of templates. A negative max_shared
+// removes the policy, allowing any number of shared courses.
+func SetOverlapPolicy(db sqlQueryer, template_a int64, template_b int64, max_shared int64) error {
+	template_a, template_b = overlap_pair(template_a, template_b)
+	_, err := db.Exec(
+		"DELETE FROM ds_category_overlap WHERE template_a = ? AND template_b = ?",
+		template_a, template_b)
+	if err != nil || max_shared < 0 {
+		return err
+	}
+	_, err = db.Exec(`INSERT INTO ds_category_overlap
+		(template_a, template_b, max_shared) VALUES (?, ?, ?)`,
+		template_a, template_b, max_shared)
+	return err
+}
+
+// A class taken in a particular term. Sheets are compared on these rather than
+// taken_courses rows, so a course entered twice still counts as shared.
+type takenCourseKey struct {
+	Class_id int64
+	Term     int64
+}
+
+// The taken courses an audit counts towards some requirement
+func audit_used_courses(result *AuditResult) map[takenCourseKey]*TakenCourse {
+	used := make(map[takenCourseKey]*TakenCourse)
+	for _, course := range requirement_courses(result.Requirements) {
+		used[takenCourseKey{course.Class_id, term_index(course.Year, course.Semester)}] = course
+	}
+	return used
+}
+
+// Audit all of a user's sheets and find the courses counted by more than one
+func AuditSheets(db *sql.DB, sheets []*DegreeSheet) (*CombinedAudit, error) {
+	policies, err := GetOverlapPolicies(db)
+	if err != nil {
+		return nil, err
+	}
+	audits := make([]*AuditResult, 0)
+	for _, sheet := range sheets {
+		audit, err := AuditDegreeSheet(db, sheet)
+		if err != nil {
+			return nil, err
+		}
+		audits = append(audits, audit)
+	}
+	return combine_audits(sheets, audits, policies), nil
+}
+
+// Compare the audits of a user's sheets pairwise against the overlap policies
+func combine_audits(sheets []*DegreeSheet, audits []*AuditResult,
+	policies map[[2]int64]*OverlapPolicy) *CombinedAudit {
+	combined := new(CombinedAudit)
+	combined.Audits = audits
+	combined.Overlaps = make([]*SheetOverlap, 0)
+	used := make([]map[takenCourseKey]*TakenCourse, 0)
+	for _, audit := range audits {
+		used = append(used, audit_used_courses(audit))
+	}
+
+	for i := range sheets {
+		for j := i + 1; j < len(sheets); j++ {
+			overlap := &SheetOverlap{
+				Sheet_a:        sheets[i].Id,
+				Sheet_b:        sheets[j].Id,
+				Shared_courses: make([]*TakenCourse, 0),
+			}
+			for key, course := range used[i] {
+				if _, shared := used[j][key]; shared {
+					overlap.Shared_courses = append(overlap.Shared_courses, course)
+				}
+			}
+			if len(overlap.Shared_courses) == 0 {
+				continue
+			}
+			sort.Slice(overlap.Shared_courses, func(a, b int) bool {
+				return overlap.Shared_courses[a].Id < overlap.Shared_courses[b].Id
+			})
+
+			template_a, template_b := overlap_pair(sheets[i].Template_id,
+				sheets[j].Template_id)
+			if policy, exists := policies[[2]int64{template_a, template_b}]; exists {
+				overlap.Max_shared = sql.NullInt64{Int64: policy.Max_shared, Valid: true}
+				overlap.Over_shared = int64(len(overlap.Shared_courses)) > policy.Max_shared
+			}
+			if overlap.Over_shared {
+				combined.Over_shared = true
+			}
+			combined.Overlaps = append(combined.Overlaps, overlap)
+		}
+	}
+	return combined
+}
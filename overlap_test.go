@@ -0,0 +1,103 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestCombineAudits(t *testing.T) {
+	comp11, comp15 := test_class(11, 1), test_class(15, 1)
+	major := test_template(1, test_category_rule(1, RULE_CATEGORY, comp11, comp15))
+	minor := test_template(2, test_class_rule(2, comp11))
+
+	later := test_course(201, comp11, "A", false)
+	later.Year = 2016
+
+	cases := []struct {
+		name     string
+		policies map[[2]int64]*OverlapPolicy
+		// Courses of the major and minor sheets, and the major's saved map
+		major_taken []*TakenCourse
+		minor_taken []*TakenCourse
+		major_map   SatisfactionMap
+		shared      int
+		over_shared bool
+	}{
+		{
+			name:        "no policy",
+			policies:    map[[2]int64]*OverlapPolicy{},
+			major_taken: []*TakenCourse{test_course(100, comp11, "A", false)},
+			minor_taken: []*TakenCourse{test_course(200, comp11, "A", false)},
+			shared:      1,
+		},
+		{
+			name:        "within the limit",
+			policies:    map[[2]int64]*OverlapPolicy{{1, 2}: {1, 2, 1}},
+			major_taken: []*TakenCourse{test_course(100, comp11, "A", false)},
+			minor_taken: []*TakenCourse{test_course(200, comp11, "A", false)},
+			shared:      1,
+		},
+		{
+			name:        "over the limit",
+			policies:    map[[2]int64]*OverlapPolicy{{1, 2}: {1, 2, 0}},
+			major_taken: []*TakenCourse{test_course(100, comp11, "A", false)},
+			minor_taken: []*TakenCourse{test_course(200, comp11, "A", false)},
+			shared:      1,
+			over_shared: true,
+		},
+		{
+			name:        "same class in another term",
+			policies:    map[[2]int64]*OverlapPolicy{{1, 2}: {1, 2, 0}},
+			major_taken: []*TakenCourse{test_course(100, comp11, "A", false)},
+			minor_taken: []*TakenCourse{later},
+			shared:      0,
+		},
+		{
+			// The major could count COMP 15 instead, but its audit picks
+			// COMP 11 without looking at the minor. The check is advisory.
+			name:     "avoidable sharing is still flagged",
+			policies: map[[2]int64]*OverlapPolicy{{1, 2}: {1, 2, 0}},
+			major_taken: []*TakenCourse{
+				test_course(100, comp11, "A", false),
+				test_course(101, comp15, "A", false),
+			},
+			minor_taken: []*TakenCourse{test_course(200, comp11, "A", false)},
+			shared:      1,
+			over_shared: true,
+		},
+		{
+			name:     "a saved map avoids the sharing",
+			policies: map[[2]int64]*OverlapPolicy{{1, 2}: {1, 2, 0}},
+			major_taken: []*TakenCourse{
+				test_course(100, comp11, "A", false),
+				test_course(101, comp15, "A", false),
+			},
+			minor_taken: []*TakenCourse{test_course(200, comp11, "A", false)},
+			major_map:   SatisfactionMap{"1": 101},
+			shared:      0,
+		},
+	}
+	for _, c := range cases {
+		major_map := c.major_map
+		if major_map == nil {
+			major_map = make(SatisfactionMap)
+		}
+		sheets := []*DegreeSheet{
+			{Id: 1, Template_id: major.Id, Taken_courses: c.major_taken},
+			{Id: 2, Template_id: minor.Id, Taken_courses: c.minor_taken},
+		}
+		audits := []*AuditResult{
+			AuditTemplate(major, c.major_taken, nil, major_map),
+			AuditTemplate(minor, c.minor_taken, nil, make(SatisfactionMap)),
+		}
+		combined := combine_audits(sheets, audits, c.policies)
+
+		shared := 0
+		for _, overlap := range combined.Overlaps {
+			shared += len(overlap.Shared_courses)
+		}
+		if shared != c.shared || combined.Over_shared != c.over_shared {
+			t.Errorf("%s: got %d shared, over shared %v, want %d %v", c.name, shared,
+				combined.Over_shared, c.shared, c.over_shared)
+		}
+	}
+}
@@ -0,0 +1,428 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"math"
+	"sort"
+	"time"
+)
+
+/*
+ * Multi-semester plans built from the planned_class rows of a user
+ */
+
+// The courses planned for one term. Courses not scheduled yet are grouped
+// into a term with no year and semester.
+type PlanTerm struct {
+	Year         sql.NullInt64
+	Semester     sql.NullInt64
+	Courses      []*PlannedClass
+	Course_count int64
+	Credits      float64
+}
+
+// Group planned courses by term, in term order, with the unscheduled
+// courses last
+func GroupPlanByTerm(planned []*PlannedClass) []*PlanTerm {
+	terms := make([]*PlanTerm, 0)
+	by_term := make(map[int64]*PlanTerm)
+	var unscheduled *PlanTerm
+	for _, planned_class := range planned {
+		var term *PlanTerm
+		if planned_class.Year.Valid && planned_class.Semester.Valid {
+			index := term_index(planned_class.Year.Int64, planned_class.Semester.Int64)
+			term = by_term[index]
+			if term == nil {
+				term = &PlanTerm{
+					Year:     planned_class.Year,
+					Semester: planned_class.Semester,
+					Courses:  make([]*PlannedClass, 0),
+				}
+				by_term[index] = term
+				terms = append(terms, term)
+			}
+		} else {
+			if unscheduled == nil {
+				unscheduled = &PlanTerm{Courses: make([]*PlannedClass, 0)}
+			}
+			term = unscheduled
+		}
+		term.Courses = append(term.Courses, planned_class)
+		term.Course_count++
+		if planned_class.Class != nil {
+			term.Credits += class_credits(planned_class.Class)
+		}
+	}
+
+	sort.Slice(terms, func(i, j int) bool {
+		return term_index(terms[i].Year.Int64, terms[i].Semester.Int64) <
+			term_index(terms[j].Year.Int64, terms[j].Semester.Int64)
+	})
+	if unscheduled != nil {
+		terms = append(terms, unscheduled)
+	}
+	return terms
+}
+
+// Semesters are numbered within a calendar year, 1 for spring and 2 for fall
+const semesters_per_year = 2
+
+func next_term(year int64, semester int64) (int64, int64) {
+	if semester >= semesters_per_year {
+		return year + 1, 1
+	}
+	return year, semester + 1
+}
+
+func current_term(now time.Time) (int64, int64) {
+	if now.Month() < time.July {
+		return int64(now.Year()), 1
+	}
+	return int64(now.Year()), 2
+}
+
+// A term in which a class is taught. Offerings without a year repeat every
+// year.
+type ClassOffering struct {
+	Class_id int64
+	Year     sql.NullInt64
+	Semester int64
+}
+
+func GetClassOfferings(db sqlQueryer) (map[int64][]*ClassOffering, error) {
+	rows, err := db.Query("SELECT class_id, year, semester FROM class_offering")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	offerings := make(map[int64][]*ClassOffering)
+	for rows.Next() {
+		offering := new(ClassOffering)
+		if err := rows.Scan(
+			&offering.Class_id,
+			&offering.Year,
+			&offering.Semester); err != nil {
+			return nil, err
+		}
+		offerings[offering.Class_id] = append(offerings[offering.Class_id], offering)
+	}
+	return offerings, rows.Err()
+}
+
+// Whether a class is taught in a term. Classes without any known offerings
+// are assumed to be taught every term.
+func class_offered(offerings map[int64][]*ClassOffering, class_id int64,
+	year int64, semester int64) bool {
+	class_offerings, known := offerings[class_id]
+	if !known {
+		return true
+	}
+	for _, offering := range class_offerings {
+		if offering.Semester == semester &&
+			(!offering.Year.Valid || offering.Year.Int64 == year) {
+			return true
+		}
+	}
+	return false
+}
+
+type PlanOptions struct {
+	Max_per_term        int64
+	Start_year          int64
+	Start_semester      int64
+	Graduation_year     int64
+	Graduation_semester int64
+}
+
+// A proposed plan. Its courses are not saved until the user accepts them.
+type GeneratedPlan struct {
+	Terms []*PlanTerm
+	// Requirements and classes that could not be fitted into the plan
+	Problems []string
+}
+
+// Propose a term by term plan that fills the unsatisfied requirements of a
+// sheet before graduation, respecting prerequisites and term offerings.
+// Classes the user has already planned are preferred.
+func GeneratePlan(db *sql.DB, sheet *DegreeSheet, options *PlanOptions) (*GeneratedPlan, error) {
+	template, err := GetDSCategoryById(db, sheet.Template_id)
+	if err != nil {
+		return nil, err
+	}
+	offerings, err := GetClassOfferings(db)
+	if err != nil {
+		return nil, err
+	}
+	planner := new_degree_planner(db, sheet)
+	plan := &GeneratedPlan{Problems: make([]string, 0)}
+
+	// Pick a class for every course-sized requirement still open
+	audit := AuditTemplate(template, sheet.Taken_courses, make([]*PlannedClass, 0),
+		sheet.Dropped_courses)
+	needs := collect_plan_needs(template.Rules, audit.Requirements,
+		make(map[int64]bool), make([]*planNeed, 0))
+	for _, need := range needs {
+		for {
+			class, err := planner.choose_class(need.Rule)
+			if err != nil {
+				return nil, err
+			}
+			if class == nil {
+				plan.Problems = append(plan.Problems,
+					fmt.Sprintf("No class left to take for %s", rule_name(need.Rule)))
+				break
+			}
+			planner.choose(class)
+			need.Credits -= class_credits(class)
+			if need.Rule.Ruletype != RULE_CREDITS || need.Credits <= 0 {
+				break
+			}
+		}
+	}
+
+	// Add the prerequisites of the chosen classes that are not taken yet.
+	// This extends the list while walking it, so prerequisites of
+	// prerequisites are added too.
+	for i := 0; i < len(planner.chosen); i++ {
+		root, err := planner.requisites_for(planner.chosen[i].Id)
+		if err != nil {
+			return nil, err
+		}
+		if root != nil {
+			if err = planner.add_missing_requisites(root); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	// Fill the terms in order with the classes whose requisites are met by
+	// then
+	completions := taken_completions(sheet.Taken_courses)
+	proposed := make([]*PlannedClass, 0)
+	remaining := planner.chosen
+	year, semester := options.Start_year, options.Start_semester
+	graduation := term_index(options.Graduation_year, options.Graduation_semester)
+	for len(remaining) > 0 && term_index(year, semester) <= graduation {
+		term := term_index(year, semester)
+		left := make([]*Class, 0)
+		var count int64
+		for _, class := range remaining {
+			if count >= options.Max_per_term ||
+				!class_offered(offerings, class.Id, year, semester) {
+				left = append(left, class)
+				continue
+			}
+			root, err := planner.requisites_for(class.Id)
+			if err != nil {
+				return nil, err
+			}
+			if root != nil && !requisite_met(root, term, completions) {
+				left = append(left, class)
+				continue
+			}
+			count++
+			completions = append(completions, &requisiteCompletion{
+				Class_id: class.Id,
+				Term:     term,
+			})
+			proposed = append(proposed, &PlannedClass{
+				Class_id: class.Id,
+				Class:    class,
+				Year:     sql.NullInt64{Int64: year, Valid: true},
+				Semester: sql.NullInt64{Int64: semester, Valid: true},
+			})
+		}
+		remaining = left
+		year, semester = next_term(year, semester)
+	}
+	for _, class := range remaining {
+		plan.Problems = append(plan.Problems,
+			fmt.Sprintf("%s does not fit in before graduation", class_name(class)))
+	}
+
+	plan.Terms = GroupPlanByTerm(proposed)
+	return plan, nil
+}
+
+// A rule that still needs a course, or for credits rules, courses worth the
+// remaining credits
+type planNeed struct {
+	Rule    *DSCategoryRule
+	Credits float64
+}
+
+// The rules that still need a course, once per course needed. Credits rules
+// are included once with the credits they still need. Only as many children
+// of a RULE_SELECT are included as are needed to meet its count.
+func collect_plan_needs(rules []*DSCategoryRule, requirements []*AuditRequirement,
+	seen map[int64]bool, needs []*planNeed) []*planNeed {
+	for i, rule := range rules {
+		requirement := requirements[i]
+		if requirement.Satisfied || seen[rule.Id] {
+			continue
+		}
+		seen[rule.Id] = true
+
+		if rule.Ruletype == RULE_INHERIT {
+			needs = collect_plan_needs(rule.inherited.Rules, requirement.Children,
+				seen, needs)
+		} else if rule.Ruletype == RULE_SELECT {
+			missing := int(requirement.Required - requirement.Completed)
+			for j, child := range requirement.Children {
+				if missing <= 0 {
+					break
+				}
+				if child.Satisfied {
+					continue
+				}
+				needs = collect_plan_needs(rule.inherited.Rules[j:j+1],
+					requirement.Children[j:j+1], seen, needs)
+				missing--
+			}
+		} else if rule.Ruletype == RULE_CREDITS {
+			needs = append(needs, &planNeed{
+				Rule:    rule,
+				Credits: requirement.Required - requirement.Completed,
+			})
+		} else if rule.Ruletype == RULE_COUNT {
+			for n := len(requirement.Courses); n < rule_slot_count(rule); n++ {
+				needs = append(needs, &planNeed{Rule: rule})
+			}
+		} else {
+			needs = append(needs, &planNeed{Rule: rule})
+		}
+	}
+	return needs
+}
+
+// State of GeneratePlan while choosing classes
+type degreePlanner struct {
+	db *sql.DB
+	// Classes passed or in progress, which need not be planned again
+	taken map[int64]bool
+	// The taken courses as requisite completions, regardless of term
+	completions []*requisiteCompletion
+	planned     map[int64]bool
+	chosen      []*Class
+	is_chosen   map[int64]bool
+	// Requisite trees by class, nil for classes without any
+	requisites map[int64]*RequisiteNode
+	looked_up  map[int64]bool
+}
+
+func new_degree_planner(db *sql.DB, sheet *DegreeSheet) *degreePlanner {
+	planner := &degreePlanner{
+		db:          db,
+		taken:       make(map[int64]bool),
+		completions: taken_completions(sheet.Taken_courses),
+		planned:     make(map[int64]bool),
+		chosen:      make([]*Class, 0),
+		is_chosen:   make(map[int64]bool),
+		requisites:  make(map[int64]*RequisiteNode),
+		looked_up:   make(map[int64]bool),
+	}
+	for _, course := range sheet.Taken_courses {
+		if course_passed_or_in_progress(course) {
+			planner.taken[course.Class_id] = true
+		}
+	}
+	for _, completion := range planner.completions {
+		completion.Unordered = true
+	}
+	for _, planned_class := range sheet.Planned_courses {
+		planner.planned[planned_class.Class_id] = true
+	}
+	return planner
+}
+
+func (p *degreePlanner) choose(class *Class) {
+	p.chosen = append(p.chosen, class)
+	p.is_chosen[class.Id] = true
+}
+
+func (p *degreePlanner) available(class *Class) bool {
+	return !p.taken[class.Id] && !p.is_chosen[class.Id]
+}
+
+func (p *degreePlanner) requisites_for(class_id int64) (*RequisiteNode, error) {
+	if !p.looked_up[class_id] {
+		root, err := GetRequisitesForClass(p.db, class_id)
+		if err != nil {
+			return nil, err
+		}
+		p.requisites[class_id] = root
+		p.looked_up[class_id] = true
+	}
+	return p.requisites[class_id], nil
+}
+
+// Pick a class for a rule: one the user already planned, else one whose
+// requisites are already taken, else any class not taken or chosen yet.
+// Returns nil if every class of the rule is used up.
+func (p *degreePlanner) choose_class(rule *DSCategoryRule) (*Class, error) {
+	candidates := make([]*Class, 0)
+	if rule.Ruletype == RULE_CLASS {
+		candidates = append(candidates, rule.class)
+	} else if rule.class_category != nil {
+		candidates = rule.class_category.Classes
+	}
+
+	for _, class := range candidates {
+		if p.available(class) && p.planned[class.Id] {
+			return class, nil
+		}
+	}
+	var fallback *Class
+	for _, class := range candidates {
+		if !p.available(class) {
+			continue
+		}
+		root, err := p.requisites_for(class.Id)
+		if err != nil {
+			return nil, err
+		}
+		if root == nil || requisite_met(root, math.MaxInt64, p.completions) {
+			return class, nil
+		}
+		if fallback == nil {
+			fallback = class
+		}
+	}
+	return fallback, nil
+}
+
+// Choose the classes a requisite tree needs that are neither taken nor chosen.
+// Of alternatives, the first is chosen unless one is already taken or chosen.
+func (p *degreePlanner) add_missing_requisites(node *RequisiteNode) error {
+	if node.Node_type == REQUISITE_CLASS {
+		if p.taken[node.Class_id.Int64] || p.is_chosen[node.Class_id.Int64] {
+			return nil
+		}
+		class, err := GetClassById(p.db, node.Class_id.Int64)
+		if err != nil {
+			return err
+		}
+		p.choose(class)
+		return nil
+	}
+	if node.Node_type == REQUISITE_OR {
+		for _, child := range node.Children {
+			if child.Node_type == REQUISITE_CLASS &&
+				(p.taken[child.Class_id.Int64] || p.is_chosen[child.Class_id.Int64]) {
+				return nil
+			}
+		}
+		if len(node.Children) > 0 {
+			return p.add_missing_requisites(node.Children[0])
+		}
+		return nil
+	}
+	for _, child := range node.Children {
+		if err := p.add_missing_requisites(child); err != nil {
+			return err
+		}
+	}
+	return nil
+}
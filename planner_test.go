@@ -0,0 +1,153 @@
+package main
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func test_planned(class *Class, year int64, semester int64) *PlannedClass {
+	planned := &PlannedClass{Class_id: class.Id, Class: class}
+	if year != 0 {
+		planned.Year = sql.NullInt64{Int64: year, Valid: true}
+		planned.Semester = sql.NullInt64{Int64: semester, Valid: true}
+	}
+	return planned
+}
+
+func TestGroupPlanByTerm(t *testing.T) {
+	comp11, comp15, comp40 := test_class(11, 1), test_class(15, 1), test_class(40, 0.5)
+	terms := GroupPlanByTerm([]*PlannedClass{
+		test_planned(comp40, 2016, 2),
+		test_planned(comp11, 0, 0),
+		test_planned(comp15, 2016, 1),
+		test_planned(comp11, 2016, 2),
+	})
+
+	want := []struct {
+		year     int64
+		semester int64
+		courses  int64
+		credits  float64
+	}{
+		{2016, 1, 1, 1},
+		{2016, 2, 2, 1.5},
+		// Unscheduled courses come last
+		{0, 0, 1, 1},
+	}
+	if len(terms) != len(want) {
+		t.Fatalf("got %d terms, want %d", len(terms), len(want))
+	}
+	for i, term := range terms {
+		if term.Year.Int64 != want[i].year || term.Semester.Int64 != want[i].semester ||
+			term.Course_count != want[i].courses || term.Credits != want[i].credits {
+			t.Errorf("term %d: got %d-%d with %d courses, %g credits, want %+v", i,
+				term.Year.Int64, term.Semester.Int64, term.Course_count, term.Credits, want[i])
+		}
+	}
+}
+
+func TestTerms(t *testing.T) {
+	if year, semester := next_term(2015, 1); year != 2015 || semester != 2 {
+		t.Errorf("after spring 2015: got %d-%d", year, semester)
+	}
+	if year, semester := next_term(2015, 2); year != 2016 || semester != 1 {
+		t.Errorf("after fall 2015: got %d-%d", year, semester)
+	}
+	if year, semester := current_term(time.Date(2016, time.March, 1, 0, 0, 0, 0, time.UTC)); year != 2016 || semester != 1 {
+		t.Errorf("March 2016: got %d-%d", year, semester)
+	}
+	if year, semester := current_term(time.Date(2016, time.October, 1, 0, 0, 0, 0, time.UTC)); year != 2016 || semester != 2 {
+		t.Errorf("October 2016: got %d-%d", year, semester)
+	}
+}
+
+func TestFormTerm(t *testing.T) {
+	cases := []struct {
+		year     string
+		semester string
+		valid    bool
+		bad      bool
+	}{
+		{"", "", false, false},
+		{"2016", "1", true, false},
+		{"2016", "2", true, false},
+		{"2016", "0", false, true},
+		{"2016", "3", false, true},
+		{"2016", "", false, true},
+		{"", "1", false, true},
+		{"next", "1", false, true},
+	}
+	for _, c := range cases {
+		r := &http.Request{Form: url.Values{"start_year": {c.year}, "start_semester": {c.semester}}}
+		year, semester, result := form_term(r, "start_")
+		if (result != nil) != c.bad || year.Valid != c.valid || semester.Valid != c.valid {
+			t.Errorf("%q %q: got %v %v, error %v", c.year, c.semester, year, semester, result)
+		}
+	}
+}
+
+func TestPlannerTakenCourses(t *testing.T) {
+	db, _ := open_test_db(
+		&testResult{pattern: "FROM class_requisite", answer: func(args []driver.Value) [][]driver.Value {
+			if args[0].(int64) == 40 {
+				return test_requisite_rows
+			}
+			return nil
+		}},
+		&testResult{pattern: "class.credits_max FROM class", answer: func(args []driver.Value) [][]driver.Value {
+			return [][]driver.Value{{args[0], int64(1), "COMP", "Computer Science", args[0],
+				"Class", "", 1.0, nil}}
+		}},
+	)
+	comp11, comp15, comp40, comp41 := test_class(11, 1), test_class(15, 1), test_class(40, 1), test_class(41, 1)
+	// COMP 40 needs COMP 11 with a C or better, COMP 41 needs nothing
+	rule := test_category_rule(1, RULE_CATEGORY, comp40, comp41)
+
+	cases := []struct {
+		grade string
+		// Whether COMP 11 can be planned again, and the class chosen for the rule
+		retake bool
+		chosen int64
+	}{
+		{"A", false, 40},
+		{"", false, 40},
+		{"D", false, 41},
+		{"F", true, 41},
+		{"W", true, 41},
+	}
+	for _, c := range cases {
+		sheet := &DegreeSheet{Taken_courses: []*TakenCourse{
+			test_course(100, comp11, c.grade, false),
+			test_course(101, comp15, "A", false),
+		}}
+		planner := new_degree_planner(db, sheet)
+		if planner.available(comp11) != c.retake {
+			t.Errorf("grade %q: COMP 11 available %v, want %v", c.grade, !c.retake, c.retake)
+		}
+		class, err := planner.choose_class(rule)
+		if err != nil {
+			t.Errorf("grade %q: %v", c.grade, err)
+			continue
+		}
+		if class == nil || class.Id != c.chosen {
+			t.Errorf("grade %q: chose %v, want COMP %d", c.grade, class, c.chosen)
+		}
+
+		// Planning COMP 40 anyway plans a retake of a failed COMP 11
+		root, err := planner.requisites_for(40)
+		if err == nil {
+			err = planner.add_missing_requisites(root)
+		}
+		if err != nil {
+			t.Errorf("grade %q: %v", c.grade, err)
+			continue
+		}
+		if planner.is_chosen[11] != c.retake {
+			t.Errorf("grade %q: COMP 11 chosen %v, want %v", c.grade, planner.is_chosen[11], c.retake)
+		}
+	}
+}
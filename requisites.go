@@ -0,0 +1,297 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+/*
+ * Course prerequisites and corequisites. The requisites of a class are a tree
+ * of class_requisite rows: "and" and "or" nodes combine their children, and
+ * "class" nodes name a required class, optionally with a minimum grade.
+ * Corequisite class nodes may also be taken in the same term.
+ */
+
+const REQUISITE_AND = "and"
+const REQUISITE_OR = "or"
+const REQUISITE_CLASS = "class"
+
+type RequisiteNode struct {
+	Id        int64
+	Node_type string
+	// Class nodes only
+	Class_id    sql.NullInt64
+	Class_name  string
+	Min_grade   sql.NullString
+	Corequisite bool
+	Children    []*RequisiteNode
+}
+
+// Get the requisite tree of a class. Returns nil if the class has no
+// requisites.
+func GetRequisitesForClass(db sqlQueryer, class_id int64) (*RequisiteNode, error) {
+	rows, err := db.Query(`SELECT class_requisite.id, class_requisite.parent_id,
+		class_requisite.node_type, class_requisite.required_class_id,
+		subject.callsign, class.course_number, class_requisite.min_grade,
+		class_requisite.corequisite
+		FROM class_requisite
+		LEFT JOIN class ON class.id = class_requisite.required_class_id
+		LEFT JOIN subject ON subject.id = class.subject
+		WHERE class_requisite.class_id = ?
+		ORDER BY class_requisite.id`, class_id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	nodes := make(map[int64]*RequisiteNode)
+	parents := make(map[int64]int64)
+	order := make([]int64, 0)
+	var root *RequisiteNode
+	for rows.Next() {
+		node := new(RequisiteNode)
+		node.Children = make([]*RequisiteNode, 0)
+		var parent_id sql.NullInt64
+		var callsign sql.NullString
+		var number sql.NullInt64
+		if err := rows.Scan(
+			&node.Id,
+			&parent_id,
+			&node.Node_type,
+			&node.Class_id,
+			&callsign,
+			&number,
+			&node.Min_grade,
+			&node.Corequisite); err != nil {
+			return nil, err
+		}
+		if callsign.Valid {
+			node.Class_name = fmt.Sprintf("%s %d", callsign.String, number.Int64)
+		}
+		nodes[node.Id] = node
+		order = append(order, node.Id)
+		if parent_id.Valid {
+			parents[node.Id] = parent_id.Int64
+		} else if root == nil {
+			root = node
+		} else {
+			return nil, errors.New(fmt.Sprintf("Class #%d has more than one requisite tree", class_id))
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for _, id := range order {
+		parent_id, has_parent := parents[id]
+		if !has_parent {
+			continue
+		}
+		parent, exists := nodes[parent_id]
+		if !exists {
+			return nil, errors.New(fmt.Sprintf("Requisite #%d of class #%d has no parent #%d",
+				id, class_id, parent_id))
+		}
+		parent.Children = append(parent.Children, nodes[id])
+	}
+	return root, nil
+}
+
+// Get the classes that list a class among their requisites
+func GetClassesUnlockedBy(db *sql.DB, class_id int64) ([]*Class, error) {
+	rows, err := db.Query(`SELECT DISTINCT class_id FROM class_requisite
+		WHERE required_class_id = ? ORDER BY class_id`, class_id)
+	if err != nil {
+		return nil, err
+	}
+	class_ids := make([]int64, 0)
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		class_ids = append(class_ids, id)
+	}
+	rows.Close()
+
+	classes := make([]*Class, 0)
+	for _, id := range class_ids {
+		class, err := GetClassById(db, id)
+		if err != nil {
+			return nil, err
+		}
+		classes = append(classes, class)
+	}
+	return classes, nil
+}
+
+// Replace the requisites of a class with a tree. A nil tree removes them.
+func SetRequisitesForClass(tx *sql.Tx, class_id int64, root *RequisiteNode) error {
+	_, err := tx.Exec("DELETE FROM class_requisite WHERE class_id = ?", class_id)
+	if err != nil || root == nil {
+		return err
+	}
+	return insert_requisite_node(tx, class_id, sql.NullInt64{}, root)
+}
+
+func insert_requisite_node(tx *sql.Tx, class_id int64, parent_id sql.NullInt64,
+	node *RequisiteNode) error {
+	var corequisite int64
+	if node.Corequisite {
+		corequisite = 1
+	}
+	result, err := tx.Exec(`INSERT INTO class_requisite
+		(class_id, parent_id, node_type, required_class_id, min_grade, corequisite)
+		VALUES (?, ?, ?, ?, ?, ?)`,
+		class_id, parent_id, node.Node_type, node.Class_id, node.Min_grade, corequisite)
+	if err != nil {
+		return err
+	}
+	node_id, err := result.LastInsertId()
+	if err != nil {
+		return err
+	}
+	node.Id = node_id
+	for _, child := range node.Children {
+		err = insert_requisite_node(tx, class_id,
+			sql.NullInt64{Int64: node_id, Valid: true}, child)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// A taken or planned course, as far as requisite checks are concerned
+type requisiteCompletion struct {
+	Class_id int64
+	Term     int64
+	Grade    string
+	// Planned courses without a term count regardless of order
+	Unordered bool
+}
+
+// Sortable index of a term, later terms being greater
+func term_index(year int64, semester int64) int64 {
+	return year*10 + semester
+}
+
+func taken_completions(taken []*TakenCourse) []*requisiteCompletion {
+	completions := make([]*requisiteCompletion, 0)
+	for _, course := range taken {
+		completions = append(completions, &requisiteCompletion{
+			Class_id: course.Class_id,
+			Term:     term_index(course.Year, course.Semester),
+			Grade:    course.Grade,
+		})
+	}
+	return completions
+}
+
+func planned_completions(planned []*PlannedClass) []*requisiteCompletion {
+	completions := make([]*requisiteCompletion, 0)
+	for _, planned_class := range planned {
+		completion := &requisiteCompletion{
+			Class_id:  planned_class.Class_id,
+			Unordered: true,
+		}
+		if planned_class.Year.Valid && planned_class.Semester.Valid {
+			completion.Term = term_index(planned_class.Year.Int64,
+				planned_class.Semester.Int64)
+			completion.Unordered = false
+		}
+		completions = append(completions, completion)
+	}
+	return completions
+}
+
+// Check the requisites of a class taken or planned in a term against the
+// other courses of the user. Returns a warning for each unmet requisite.
+func check_requisites(db sqlQueryer, class_id int64, term int64,
+	completions []*requisiteCompletion) ([]string, error) {
+	root, err := GetRequisitesForClass(db, class_id)
+	if err != nil || root == nil {
+		return make([]string, 0), err
+	}
+
+	// Report each unmet part of the top level "and" separately
+	parts := []*RequisiteNode{root}
+	if root.Node_type == REQUISITE_AND {
+		parts = root.Children
+	}
+	warnings := make([]string, 0)
+	for _, part := range parts {
+		if !requisite_met(part, term, completions) {
+			warnings = append(warnings, fmt.Sprintf("Requires %s", describe_requisite(part)))
+		}
+	}
+	return warnings, nil
+}
+
+func requisite_met(node *RequisiteNode, term int64, completions []*requisiteCompletion) bool {
+	if node.Node_type == REQUISITE_AND {
+		for _, child := range node.Children {
+			if !requisite_met(child, term, completions) {
+				return false
+			}
+		}
+		return true
+	} else if node.Node_type == REQUISITE_OR {
+		for _, child := range node.Children {
+			if requisite_met(child, term, completions) {
+				return true
+			}
+		}
+		return false
+	}
+
+	for _, completion := range completions {
+		if completion.Class_id != node.Class_id.Int64 {
+			continue
+		}
+		if !completion.Unordered {
+			// Corequisites may be taken in the same term
+			if completion.Term > term || completion.Term == term && !node.Corequisite {
+				continue
+			}
+		}
+		grade, grade_known := ParseGrade(completion.Grade)
+		if grade_known && !grade.Passing {
+			continue
+		}
+		if node.Min_grade.Valid && grade_known {
+			minimum, _ := ParseGrade(node.Min_grade.String)
+			if !GradeAtLeast(grade, minimum) {
+				continue
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// Human readable form of a requisite tree, e.g. "COMP 11 and (MATH 32 or MATH 34)"
+func describe_requisite(node *RequisiteNode) string {
+	if node.Node_type == REQUISITE_CLASS {
+		description := node.Class_name
+		if node.Min_grade.Valid {
+			description += fmt.Sprintf(" (%s or better)", node.Min_grade.String)
+		}
+		if node.Corequisite {
+			description += " (may be taken concurrently)"
+		}
+		return description
+	}
+	parts := make([]string, 0)
+	for _, child := range node.Children {
+		if child.Node_type == REQUISITE_CLASS {
+			parts = append(parts, describe_requisite(child))
+		} else {
+			parts = append(parts, "("+describe_requisite(child)+")")
+		}
+	}
+	return strings.Join(parts, " "+node.Node_type+" ")
+}
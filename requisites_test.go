@@ -0,0 +1,77 @@
+package main
+
+import (
+	"database/sql/driver"
+	"reflect"
+	"testing"
+)
+
+// COMP 40 requires COMP 11 with a C or better, and either COMP 15 or MATH 22,
+// which may be taken alongside it
+var test_requisite_rows = [][]driver.Value{
+	{int64(1), nil, REQUISITE_AND, nil, nil, nil, nil, int64(0)},
+	{int64(2), int64(1), REQUISITE_CLASS, int64(11), "COMP", int64(11), "C", int64(0)},
+	{int64(3), int64(1), REQUISITE_OR, nil, nil, nil, nil, int64(0)},
+	{int64(4), int64(3), REQUISITE_CLASS, int64(15), "COMP", int64(15), nil, int64(0)},
+	{int64(5), int64(3), REQUISITE_CLASS, int64(22), "MATH", int64(22), nil, int64(1)},
+}
+
+func test_completion(class_id int64, term int64, grade string) *requisiteCompletion {
+	return &requisiteCompletion{Class_id: class_id, Term: term, Grade: grade}
+}
+
+func TestCheckRequisites(t *testing.T) {
+	db, _ := open_test_db(&testResult{pattern: "FROM class_requisite", answer: func(args []driver.Value) [][]driver.Value {
+		if args[0].(int64) == 40 {
+			return test_requisite_rows
+		}
+		return nil
+	}})
+	fall, spring := term_index(2015, 2), term_index(2016, 1)
+	comp15 := test_completion(15, fall, "A")
+	either := "Requires COMP 15 or MATH 22 (may be taken concurrently)"
+
+	cases := []struct {
+		name        string
+		completions []*requisiteCompletion
+		want        []string
+	}{
+		{"nothing taken", []*requisiteCompletion{},
+			[]string{"Requires COMP 11 (C or better)", either}},
+		{"all taken before", []*requisiteCompletion{test_completion(11, fall, "B"), comp15},
+			[]string{}},
+		{"grade below the minimum", []*requisiteCompletion{test_completion(11, fall, "D"), comp15},
+			[]string{"Requires COMP 11 (C or better)"}},
+		{"failed", []*requisiteCompletion{test_completion(11, fall, "F"), comp15},
+			[]string{"Requires COMP 11 (C or better)"}},
+		{"still in progress", []*requisiteCompletion{test_completion(11, fall, ""), comp15},
+			[]string{}},
+		{"taken in the same term", []*requisiteCompletion{test_completion(11, spring, "A"), comp15},
+			[]string{"Requires COMP 11 (C or better)"}},
+		{"corequisite in the same term", []*requisiteCompletion{
+			test_completion(11, fall, "A"), test_completion(22, spring, "")},
+			[]string{}},
+		{"taken later", []*requisiteCompletion{
+			test_completion(11, fall, "A"), test_completion(15, term_index(2016, 2), "A")},
+			[]string{either}},
+		{"planned without a term", []*requisiteCompletion{
+			{Class_id: 11, Unordered: true}, comp15},
+			[]string{}},
+	}
+	for _, c := range cases {
+		warnings, err := check_requisites(db, 40, spring, c.completions)
+		if err != nil {
+			t.Errorf("%s: %v", c.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(warnings, c.want) {
+			t.Errorf("%s: got %q, want %q", c.name, warnings, c.want)
+		}
+	}
+
+	// Classes without requisites never warn
+	warnings, err := check_requisites(db, 11, spring, []*requisiteCompletion{})
+	if err != nil || len(warnings) != 0 {
+		t.Errorf("no requisites: got %q, %v", warnings, err)
+	}
+}
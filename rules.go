@@ -2,13 +2,213 @@ package main
 
 import (
 	"database/sql"
+	"fmt"
 	_ "github.com/go-sql-driver/mysql"
+	"strconv"
+	"strings"
+	"time"
 )
 
 const RULE_CLASS = 1
 const RULE_CATEGORY = 2
 const RULE_INHERIT = 4
 
+// Satisfied by Min_count of the rules of the inherited template
+const RULE_SELECT = 8
+
+// Satisfied by Min_count courses from a class category
+const RULE_COUNT = 16
+
+// Satisfied by Min_credits worth of courses from a class category
+const RULE_CREDITS = 32
+
+// The names of the ruletypes, as in ds_category_ruletype
+var ruletype_names = map[int64]string{
+	RULE_CLASS:    "class",
+	RULE_CATEGORY: "category",
+	RULE_INHERIT:  "inherit",
+	RULE_SELECT:   "select",
+	RULE_COUNT:    "count",
+	RULE_CREDITS:  "credits",
+}
+
+// Whether the template loader understands a ruletype
+func ruletype_known(ruletype int64) bool {
+	_, known := ruletype_names[ruletype]
+	return known
+}
+
+// Find the chain of inheriting rules that leads from a template to the
+// template with the given ID. Returns nil if the template doesn't inherit it.
+func inheritance_path(template *DSCategory, target int64) []*DSCategoryRule {
+	for _, rule := range template.Rules {
+		if rule.inherited == nil {
+			continue
+		}
+		if rule.inherited.Id == target {
+			return []*DSCategoryRule{rule}
+		}
+		if path := inheritance_path(rule.inherited, target); path != nil {
+			return append([]*DSCategoryRule{rule}, path...)
+		}
+	}
+	return nil
+}
+
+// Add a rule to a template. Returns the ID of the new rule.
+func InsertDSCategoryRule(db sqlQueryer, rule *DSCategoryRule) (int64, error) {
+	// A NULL passfail_allowed places no restriction on the rule
+	var passfail_allowed sql.NullInt64
+	if !rule.Passfail_allowed {
+		passfail_allowed = sql.NullInt64{Int64: 0, Valid: true}
+	}
+	result, err := db.Exec(`INSERT INTO ds_category_rule
+		(category, ruletype, class_id, category_id, inherited_id,
+		passfail_allowed, min_count, min_credits, min_grade)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		rule.Category, rule.Ruletype, rule.Class_id, rule.Category_id,
+		rule.Inherit_id, passfail_allowed, rule.Min_count, rule.Min_credits,
+		rule.Min_grade)
+	if err != nil {
+		return 0, err
+	}
+	return result.LastInsertId()
+}
+
+// A template name that is already taken
+type TemplateNameError struct {
+	Name string
+}
+
+func (e *TemplateNameError) Error() string {
+	return fmt.Sprintf("A template named %s already exists", e.Name)
+}
+
+// Check that no template other than except_id is called name. Returns a
+// *TemplateNameError if one is.
+func check_template_name(db sqlQueryer, name string, except_id int64) error {
+	var taken int64
+	err := db.QueryRow("SELECT COUNT(*) FROM ds_category WHERE name = ? AND id != ?",
+		name, except_id).Scan(&taken)
+	if err != nil {
+		return err
+	}
+	if taken > 0 {
+		return &TemplateNameError{Name: name}
+	}
+	return nil
+}
+
+// Copy a template and everything it inherits into a new catalog year, as a
+// starting point for the new year's requirements. The catalog year in the
+// names of the templates is replaced, and the effective dates moved by the
+// same number of years. Inherited templates without a catalog year aren't
+// tied to one and are shared with the copy rather than copied. The copy of
+// the template itself is called name if one is given. Returns the ID of the
+// copy.
+func CloneTemplate(db *sql.DB, template_id int64, catalog_year int64,
+	name string) (int64, error) {
+	template, err := GetDSCategoryById(db, template_id)
+	if err != nil {
+		return 0, err
+	}
+	old_year := template.Catalog_year.Int64
+	if !template.Catalog_year.Valid {
+		old_year = catalog_year
+	}
+	years := int(catalog_year - old_year)
+
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	clones := make(map[int64]int64)
+	var clone func(category *DSCategory) (int64, error)
+	clone = func(category *DSCategory) (int64, error) {
+		if clone_id, cloned := clones[category.Id]; cloned {
+			return clone_id, nil
+		}
+		if category != template && !category.Catalog_year.Valid {
+			return category.Id, nil
+		}
+
+		clone_name := category.Name
+		if category == template && name != "" {
+			clone_name = name
+		} else if category.Catalog_year.Valid {
+			year_s := strconv.FormatInt(category.Catalog_year.Int64, 10)
+			if strings.Contains(clone_name, year_s) {
+				clone_name = strings.Replace(clone_name, year_s,
+					strconv.FormatInt(catalog_year, 10), -1)
+			} else {
+				clone_name = fmt.Sprintf("%s_%d", clone_name, catalog_year)
+			}
+		}
+		if err := check_template_name(tx, clone_name, 0); err != nil {
+			return 0, err
+		}
+		clone_year := category.Catalog_year
+		if clone_year.Valid {
+			clone_year.Int64 = catalog_year
+		}
+		effective_from := category.Effective_from
+		if effective_from.Valid {
+			effective_from.Time = effective_from.Time.AddDate(years, 0, 0)
+		}
+		effective_to := category.Effective_to
+		if effective_to.Valid {
+			effective_to.Time = effective_to.Time.AddDate(years, 0, 0)
+		}
+
+		result, err := tx.Exec(`INSERT INTO ds_category
+			(name, program, catalog_year, effective_from, effective_to)
+			VALUES (?, ?, ?, ?, ?)`,
+			clone_name, category.Program, clone_year, effective_from, effective_to)
+		if err != nil {
+			return 0, err
+		}
+		clone_id, err := result.LastInsertId()
+		if err != nil {
+			return 0, err
+		}
+		clones[category.Id] = clone_id
+
+		for _, rule := range category.Rules {
+			rule_clone := *rule
+			rule_clone.Category = clone_id
+			if rule.inherited != nil {
+				inherited_id, err := clone(rule.inherited)
+				if err != nil {
+					return 0, err
+				}
+				rule_clone.Inherit_id = sql.NullInt64{Int64: inherited_id, Valid: true}
+			}
+			if _, err := InsertDSCategoryRule(tx, &rule_clone); err != nil {
+				return 0, err
+			}
+		}
+		return clone_id, nil
+	}
+
+	clone_id, err := clone(template)
+	if err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+	if err = tx.Commit(); err != nil {
+		return 0, err
+	}
+	return clone_id, nil
+}
+
+// SQL condition matching a class_category_rule row (as rule) against a class
+// and its subject. A rule either names a class, or matches every class of a
+// subject within an optional course number range.
+const class_category_rule_match = `(rule.class_id = class.id OR
+	(rule.class_id IS NULL AND rule.subject = subject.callsign
+	AND class.course_number >= IFNULL(rule.number_min, class.course_number)
+	AND class.course_number <= IFNULL(rule.number_max, class.course_number)))`
+
 // Get classes matched by a rule by Id
 func GetClassesForCategoryById(db *sql.DB, id int64) (map[int64]*Class, error) {
 	class_category, err := GetClassCategoryById(db, id)
@@ -27,7 +227,8 @@ func GetClassesForCategoryById(db *sql.DB, id int64) (map[int64]*Class, error) {
 
 // Get list of categories
 func GetCategories(db *sql.DB) ([]*DSCategory, error) {
-	rows, err := db.Query("SELECT id, name from ds_category")
+	rows, err := db.Query(`SELECT id, name, program, catalog_year,
+	effective_from, effective_to from ds_category`)
 	if err != nil {
 		return nil, err
 	}
@@ -37,7 +238,11 @@ func GetCategories(db *sql.DB) ([]*DSCategory, error) {
 		category := new(DSCategory)
 		if err := rows.Scan(
 			&category.Id,
-			&category.Name); err != nil {
+			&category.Name,
+			&category.Program,
+			&category.Catalog_year,
+			&category.Effective_from,
+			&category.Effective_to); err != nil {
 			return nil, err
 		}
 		categories = append(categories, category)
@@ -45,10 +250,62 @@ func GetCategories(db *sql.DB) ([]*DSCategory, error) {
 	return categories, nil
 }
 
+// The date from which the requirements for a class year apply. Class years
+// are years of graduation, so this is the start of the fall term four years
+// earlier.
+func class_year_start(class_year int64) time.Time {
+	return time.Date(int(class_year)-4, time.September, 1, 0, 0, 0, 0, time.UTC)
+}
+
+// Whether a template applies to the students of a class year. Templates with
+// effective dates apply to the students entering between them, otherwise
+// the students entering in the template's catalog year.
+func template_applies_to_class_year(template *DSCategory, class_year int64) bool {
+	start := class_year_start(class_year)
+	if template.Effective_from.Valid || template.Effective_to.Valid {
+		if template.Effective_from.Valid && start.Before(template.Effective_from.Time) {
+			return false
+		}
+		if template.Effective_to.Valid && !start.Before(template.Effective_to.Time) {
+			return false
+		}
+		return true
+	}
+	return template.Catalog_year.Valid &&
+		template.Catalog_year.Int64 == int64(start.Year())
+}
+
+// Get the top level templates that apply to a class year, optionally only
+// those of one program
+func GetTemplatesForClassYear(db *sql.DB, class_year int64, program string) ([]*DSCategory, error) {
+	categories, err := GetCategories(db)
+	if err != nil {
+		return nil, err
+	}
+	templates := make([]*DSCategory, 0)
+	for _, category := range categories {
+		if !category.Program.Valid {
+			continue
+		}
+		if program != "" && category.Program.String != program {
+			continue
+		}
+		if template_applies_to_class_year(category, class_year) {
+			templates = append(templates, category)
+		}
+	}
+	return templates, nil
+}
+
 // Get all categories that a class can be counted towards
 func GetCategoriesMatchedbyClass(db *sql.DB, class_id int64) ([]*ClassCategory, error) {
-	rows, err := db.Query(`SELECT DISTINCT(category)
-	FROM class_category_rule WHERE class_id = ?`, class_id)
+	rows, err := db.Query(`SELECT DISTINCT(rule.category)
+	FROM class, subject, class_category_rule AS rule
+	WHERE class.id = ? AND class.subject = subject.id AND rule.exclude = 0
+	AND `+class_category_rule_match+`
+	AND NOT EXISTS (SELECT 1 FROM class_category_rule AS excluded
+		WHERE excluded.category = rule.category AND excluded.exclude = 1
+		AND excluded.class_id = class.id)`, class_id)
 	if err != nil {
 		return nil, err
 	}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+/*
+ * Validation of user supplied satisfaction maps
+ */
+
+// A problem with a single entry of a satisfaction map
+type SatisfactionError struct {
+	Requirement_id string
+	Satisfier_id   int64
+	Error          string
+}
+
+// Check a satisfaction map against a template and the courses on a sheet.
+// Returns one error per offending entry, or an empty list if the map is valid.
+func ValidateSatisfactionMap(template *DSCategory, taken []*TakenCourse,
+	sat_map SatisfactionMap) []*SatisfactionError {
+	errors := make([]*SatisfactionError, 0)
+
+	rules := make(map[string]*DSCategoryRule)
+	for _, slot := range template_slots(template) {
+		rules[slot.Id] = slot.Rule
+	}
+	courses := make(map[int64]*TakenCourse)
+	for _, course := range taken {
+		courses[course.Id] = course
+	}
+
+	// Walk the map in a fixed order so that double counting is always
+	// reported against the same entries
+	requirement_ids := make([]string, 0, len(sat_map))
+	for requirement_id := range sat_map {
+		requirement_ids = append(requirement_ids, requirement_id)
+	}
+	sort.Strings(requirement_ids)
+
+	used_by := make(map[int64]string)
+	for _, requirement_id := range requirement_ids {
+		satisfier_id := sat_map[requirement_id]
+		entry_error := func(message string) {
+			errors = append(errors, &SatisfactionError{
+				Requirement_id: requirement_id,
+				Satisfier_id:   satisfier_id,
+				Error:          message,
+			})
+		}
+
+		rule, exists := rules[requirement_id]
+		if !exists {
+			entry_error(fmt.Sprintf("No requirement %s in template %s",
+				requirement_id, template.Name))
+			continue
+		}
+		course, exists := courses[satisfier_id]
+		if !exists {
+			entry_error(fmt.Sprintf("Course #%d is not on this sheet", satisfier_id))
+			continue
+		}
+		if reason := course_eligibility_error(rule, course); reason != "" {
+			entry_error(reason)
+			continue
+		}
+		if other, used := used_by[course.Id]; used {
+			entry_error(fmt.Sprintf("Course #%d is already counted towards requirement %s",
+				course.Id, other))
+			continue
+		}
+		used_by[course.Id] = requirement_id
+	}
+	return errors
+}
+
+// The result of moving a satisfaction map to another template
+type SatisfactionMigration struct {
+	Satisfaction_map SatisfactionMap
+
+	// Entries with no matching requirement in the new template
+	Dropped []*SatisfactionError
+	// Entries whose requirement exists, but which the new template does not
+	// accept (e.g. a stricter minimum grade)
+	Invalid []*SatisfactionError
+}
+
+// Carry the entries of a satisfaction map over to another template. An entry
+// is kept if the new template has the same requirement, either because both
+// templates share the rule or because the new template has a rule asking for
+// the same class or category.
+func MigrateSatisfactionMap(old_template *DSCategory, new_template *DSCategory,
+	taken []*TakenCourse, sat_map SatisfactionMap) *SatisfactionMigration {
+	migration := &SatisfactionMigration{
+		Satisfaction_map: make(SatisfactionMap),
+		Dropped:          make([]*SatisfactionError, 0),
+		Invalid:          make([]*SatisfactionError, 0),
+	}
+
+	old_slots := make(map[string]*requirementSlot)
+	for _, slot := range template_slots(old_template) {
+		old_slots[slot.Id] = slot
+	}
+	new_slots := make(map[string]bool)
+	equivalent_slots := make(map[string][]string)
+	for _, slot := range template_slots(new_template) {
+		new_slots[slot.Id] = true
+		key := slot_target_key(slot)
+		equivalent_slots[key] = append(equivalent_slots[key], slot.Id)
+	}
+
+	requirement_ids := make([]string, 0, len(sat_map))
+	for requirement_id := range sat_map {
+		requirement_ids = append(requirement_ids, requirement_id)
+	}
+	sort.Strings(requirement_ids)
+
+	// Requirements shared by both templates keep their entries first, so that
+	// an equivalent rule cannot take their place
+	moved := make(map[string]string)
+	taken_slots := make(map[string]bool)
+	for _, requirement_id := range requirement_ids {
+		if new_slots[requirement_id] {
+			moved[requirement_id] = requirement_id
+			taken_slots[requirement_id] = true
+		}
+	}
+	for _, requirement_id := range requirement_ids {
+		if _, done := moved[requirement_id]; done {
+			continue
+		}
+		slot, exists := old_slots[requirement_id]
+		if !exists {
+			continue
+		}
+		for _, new_id := range equivalent_slots[slot_target_key(slot)] {
+			if !taken_slots[new_id] {
+				moved[requirement_id] = new_id
+				taken_slots[new_id] = true
+				break
+			}
+		}
+	}
+
+	candidate := make(SatisfactionMap)
+	for _, requirement_id := range requirement_ids {
+		new_id, found := moved[requirement_id]
+		if !found {
+			migration.Dropped = append(migration.Dropped, &SatisfactionError{
+				Requirement_id: requirement_id,
+				Satisfier_id:   sat_map[requirement_id],
+				Error: fmt.Sprintf("No matching requirement in template %s",
+					new_template.Name),
+			})
+			continue
+		}
+		candidate[new_id] = sat_map[requirement_id]
+	}
+
+	invalid := make(map[string]bool)
+	for _, map_error := range ValidateSatisfactionMap(new_template, taken, candidate) {
+		invalid[map_error.Requirement_id] = true
+		migration.Invalid = append(migration.Invalid, map_error)
+	}
+	for requirement_id, satisfier_id := range candidate {
+		if !invalid[requirement_id] {
+			migration.Satisfaction_map[requirement_id] = satisfier_id
+		}
+	}
+	return migration
+}
+
+// Identifies what a slot asks for independently of the template it is in,
+// e.g. the second course of a count rule over some category
+func slot_target_key(slot *requirementSlot) string {
+	return rule_target_key(slot.Rule) + strings.TrimPrefix(slot.Id, requirement_id(slot.Rule))
+}
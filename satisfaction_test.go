@@ -0,0 +1,108 @@
+package main
+
+import (
+	"database/sql"
+	"reflect"
+	"testing"
+)
+
+// The requirement IDs of satisfaction map errors
+func satisfaction_error_ids(errors []*SatisfactionError) []string {
+	ids := make([]string, 0)
+	for _, map_error := range errors {
+		ids = append(ids, map_error.Requirement_id)
+	}
+	return ids
+}
+
+func TestValidateSatisfactionMap(t *testing.T) {
+	comp11, comp15 := test_class(11, 1), test_class(15, 1)
+	template := test_template(1,
+		test_class_rule(1, comp11),
+		test_category_rule(2, RULE_CATEGORY, comp11, comp15))
+	taken := []*TakenCourse{
+		test_course(100, comp11, "A", false),
+		test_course(101, comp15, "B", false),
+		test_course(102, comp11, "F", false),
+	}
+
+	cases := []struct {
+		name    string
+		sat_map SatisfactionMap
+		// Requirements with an error
+		want []string
+	}{
+		{"empty map", SatisfactionMap{}, []string{}},
+		{"valid map", SatisfactionMap{"1": 100, "2": 101}, []string{}},
+		{"unknown requirement", SatisfactionMap{"1": 100, "9": 101}, []string{"9"}},
+		{"course not on the sheet", SatisfactionMap{"1": 999}, []string{"1"}},
+		{"class does not match the rule", SatisfactionMap{"1": 101}, []string{"1"}},
+		{"failed course", SatisfactionMap{"1": 102}, []string{"1"}},
+		{"course counted twice", SatisfactionMap{"1": 100, "2": 100}, []string{"2"}},
+	}
+	for _, c := range cases {
+		got := satisfaction_error_ids(ValidateSatisfactionMap(template, taken, c.sat_map))
+		if !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%s: got errors for %v, want %v", c.name, got, c.want)
+		}
+	}
+}
+
+func TestMigrateSatisfactionMap(t *testing.T) {
+	comp11, comp15, comp40 := test_class(11, 1), test_class(15, 1), test_class(40, 1)
+	shared := test_class_rule(1, comp11)
+	old_template := test_template(1,
+		shared,
+		test_category_rule(2, RULE_CATEGORY, comp11, comp15),
+		test_class_rule(3, comp40),
+		test_class_rule(4, comp15))
+
+	// The same category as rule 2, and a stricter rule for COMP 15
+	same_category := test_category_rule(5, RULE_CATEGORY, comp11, comp15)
+	same_category.Category_id = sql.NullInt64{Int64: 2, Valid: true}
+	stricter := test_class_rule(7, comp15)
+	stricter.Min_grade = sql.NullString{String: "A", Valid: true}
+	new_template := test_template(2, shared, same_category, stricter)
+
+	taken := []*TakenCourse{
+		test_course(100, comp11, "A", false),
+		test_course(101, comp15, "B", false),
+		test_course(102, comp40, "A", false),
+		test_course(103, comp15, "C", false),
+	}
+	migration := MigrateSatisfactionMap(old_template, new_template, taken,
+		SatisfactionMap{"1": 100, "2": 101, "3": 102, "4": 103})
+
+	if want := (SatisfactionMap{"1": 100, "5": 101}); !reflect.DeepEqual(
+		migration.Satisfaction_map, want) {
+		t.Errorf("got map %v, want %v", migration.Satisfaction_map, want)
+	}
+	if got := satisfaction_error_ids(migration.Dropped); !reflect.DeepEqual(got, []string{"3"}) {
+		t.Errorf("got dropped %v, want [3]", got)
+	}
+	if got := satisfaction_error_ids(migration.Invalid); !reflect.DeepEqual(got, []string{"7"}) {
+		t.Errorf("got invalid %v, want [7]", got)
+	}
+}
+
+func TestMigrateSatisfactionMapSharedRuleFirst(t *testing.T) {
+	comp11 := test_class(11, 1)
+	shared := test_class_rule(2, comp11)
+	old_template := test_template(1, test_class_rule(1, comp11), shared)
+	new_template := test_template(2, shared)
+	taken := []*TakenCourse{
+		test_course(100, comp11, "A", false),
+		test_course(101, comp11, "B", false),
+	}
+
+	// Rule 1 asks for the same class as rule 2, but rule 2 is in both
+	// templates and keeps its own entry
+	migration := MigrateSatisfactionMap(old_template, new_template, taken,
+		SatisfactionMap{"1": 100, "2": 101})
+	if want := (SatisfactionMap{"2": 101}); !reflect.DeepEqual(migration.Satisfaction_map, want) {
+		t.Errorf("got map %v, want %v", migration.Satisfaction_map, want)
+	}
+	if got := satisfaction_error_ids(migration.Dropped); !reflect.DeepEqual(got, []string{"1"}) {
+		t.Errorf("got dropped %v, want [1]", got)
+	}
+}
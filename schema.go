@@ -7,6 +7,14 @@ import (
 	"time"
 )
 
+// The query methods shared by *sql.DB and *sql.Tx, for functions that need to
+// work inside a transaction.
+type sqlQueryer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
 /*
  * Users
  */
@@ -23,13 +31,15 @@ type UserData struct {
 	Last_login         time.Time
 	Session_token      string
 	password_reset_key string
+	// ROLE_STUDENT or ROLE_ADVISOR
+	Role string
 }
 
 // Fetches information about a user by username.
 func GetUserByName(db *sql.DB, username string) (*UserData, error) {
 	row := db.QueryRow(`SELECT id, username, password, password_salt,
 		email, first_name, last_name, class_year, account_created, last_login,
-		password_reset_key FROM degreesheep.user WHERE username = ?`, username)
+		password_reset_key, role FROM degreesheep.user WHERE username = ?`, username)
 
 	user_data := new(UserData)
 	if err := row.Scan(
@@ -43,7 +53,8 @@ func GetUserByName(db *sql.DB, username string) (*UserData, error) {
 		&user_data.Class_year,
 		&user_data.Account_created,
 		&user_data.Last_login,
-		&user_data.password_reset_key); err != nil {
+		&user_data.password_reset_key,
+		&user_data.Role); err != nil {
 		return nil, err
 	}
 
@@ -54,7 +65,7 @@ func GetUserByName(db *sql.DB, username string) (*UserData, error) {
 func GetUserById(db *sql.DB, uid int64) (*UserData, error) {
 	row := db.QueryRow(`SELECT id, username, password, password_salt,
 		email, first_name, last_name, class_year, account_created, last_login,
-		password_reset_key FROM degreesheep.user WHERE id = ?`, uid)
+		password_reset_key, role FROM degreesheep.user WHERE id = ?`, uid)
 
 	user_data := new(UserData)
 	if err := row.Scan(
@@ -68,7 +79,8 @@ func GetUserById(db *sql.DB, uid int64) (*UserData, error) {
 		&user_data.Class_year,
 		&user_data.Account_created,
 		&user_data.Last_login,
-		&user_data.password_reset_key); err != nil {
+		&user_data.password_reset_key,
+		&user_data.Role); err != nil {
 		return nil, err
 	}
 	return user_data, nil
@@ -90,13 +102,17 @@ type Class struct {
 	Course_number       int64
 	Name                string
 	Description         string
-	Instructors         []*Instructor
+	// Variable credit classes have a range from Credits up to Credits_max
+	Credits     float64
+	Credits_max sql.NullFloat64
+	Instructors []*Instructor
 }
 
 // Get the details of a class by ID
 func GetClassById(db *sql.DB, id int64) (*Class, error) {
 	row := db.QueryRow(`SELECT class.id, class.subject, subject.callsign,
-	subject.description, class.course_number, class.name, class.description FROM class,
+	subject.description, class.course_number, class.name, class.description,
+	class.credits, class.credits_max FROM class,
 	subject WHERE class.subject = subject.id
     AND class.id = ?`, id)
 	class := new(Class)
@@ -108,6 +124,8 @@ func GetClassById(db *sql.DB, id int64) (*Class, error) {
 		&class.Course_number,
 		&class.Name,
 		&class.Description,
+		&class.Credits,
+		&class.Credits_max,
 	)
 	if err != nil {
 		return nil, err
@@ -138,9 +156,16 @@ func GetClassCategoryById(db *sql.DB, id int64) (*ClassCategory, error) {
 		return nil, err
 	}
 
-	// Get the classes that the category matches
-	rows, err := db.Query(`SELECT class_id
-	FROM class_category_rule WHERE category = ?`, class_category.Id)
+	// Get the classes that the category matches, either listed explicitly or
+	// by subject and course number, leaving out any excluded classes
+	rows, err := db.Query(`SELECT DISTINCT(class.id)
+	FROM class, subject, class_category_rule AS rule
+	WHERE class.subject = subject.id AND rule.category = ? AND rule.exclude = 0
+	AND `+class_category_rule_match+`
+	AND NOT EXISTS (SELECT 1 FROM class_category_rule AS excluded
+		WHERE excluded.category = rule.category AND excluded.exclude = 1
+		AND excluded.class_id = class.id)`,
+		class_category.Id)
 	if err != nil {
 		return nil, err
 	}
@@ -162,6 +187,47 @@ func GetClassCategoryById(db *sql.DB, id int64) (*ClassCategory, error) {
 	return class_category, nil
 }
 
+/*
+ * A single row of class_category_rule. A rule either names a class, or matches
+ * all classes of a subject within a course number range.
+ */
+
+type ClassCategoryRule struct {
+	Id         int64
+	Category   int64
+	Class_id   sql.NullInt64
+	Subject    sql.NullString
+	Number_min sql.NullInt64
+	Number_max sql.NullInt64
+	Exclude    bool
+}
+
+func GetClassCategoryRules(db sqlQueryer, category_id int64) ([]*ClassCategoryRule, error) {
+	rows, err := db.Query(`SELECT id, category, class_id, subject, number_min,
+	number_max, exclude FROM class_category_rule WHERE category = ?`, category_id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	rules := make([]*ClassCategoryRule, 0)
+	for rows.Next() {
+		rule := new(ClassCategoryRule)
+		if err := rows.Scan(
+			&rule.Id,
+			&rule.Category,
+			&rule.Class_id,
+			&rule.Subject,
+			&rule.Number_min,
+			&rule.Number_max,
+			&rule.Exclude,
+		); err != nil {
+			return nil, err
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
 /*
  * Instructor
  */
@@ -301,28 +367,142 @@ type DSCategory struct {
 	Inherits   []*DSCategory
 	Classes    []*Class
 	Categories []*ClassCategory
+	Rules      []*DSCategoryRule
+
+	// Top level templates belong to a program (e.g. BSCS), and apply to the
+	// students entering in a catalog year or between the effective dates
+	Program        sql.NullString
+	Catalog_year   sql.NullInt64
+	Effective_from sql.NullTime
+	Effective_to   sql.NullTime
+
+	// Problems with the template that don't stop it from being used, e.g. a
+	// sub-template inherited through more than one path. Only set on the
+	// template that was asked for.
+	Warnings []string `json:"-"`
 }
 
 // Get the details of a category by ID
 func GetDSCategoryById(db *sql.DB, id int64) (*DSCategory, error) {
+	state := &templateLoadState{
+		loaded:       make(map[int64]*DSCategory),
+		stack:        make([]int64, 0),
+		rules:        make([]int64, 0),
+		inherited_by: make(map[int64][]int64),
+	}
+	category, err := load_ds_category(db, id, state)
+	if err != nil {
+		return nil, err
+	}
+
+	// Report diamond inheritance. The shared template is only loaded once,
+	// so its requirements are only counted once.
+	category.Warnings = make([]string, 0)
+	for _, loaded_id := range state.order {
+		if rule_ids := state.inherited_by[loaded_id]; len(rule_ids) > 1 {
+			category.Warnings = append(category.Warnings, fmt.Sprintf(
+				"Template %s is inherited through more than one path (rules %v); its requirements only count once",
+				state.loaded[loaded_id].Name, rule_ids))
+		}
+	}
+	return category, nil
+}
+
+// Maximum depth of nested RULE_INHERIT and RULE_SELECT rules in a template
+const max_template_depth = 16
+
+// Bookkeeping for loading one template and everything it inherits
+type templateLoadState struct {
+	// Every template loaded so far, so that a template inherited through
+	// several paths is only loaded once and shared
+	loaded map[int64]*DSCategory
+
+	// The templates currently being loaded, outermost first, and the rule
+	// through which each one inherits the next
+	stack []int64
+	rules []int64
+
+	// The rules inheriting each template, and the order templates were
+	// loaded in
+	inherited_by map[int64][]int64
+	order        []int64
+}
+
+// A template whose inheritance is broken, either by inheriting from itself or
+// by nesting too deeply.
+type TemplateInheritanceError struct {
+	Problem      string
+	Template_ids []int64
+	Rule_ids     []int64
+}
+
+func (e *TemplateInheritanceError) Error() string {
+	return fmt.Sprintf("%s: templates %v, rules %v", e.Problem, e.Template_ids, e.Rule_ids)
+}
+
+func load_ds_category(db *sql.DB, id int64, state *templateLoadState) (*DSCategory, error) {
+	if category, loaded := state.loaded[id]; loaded {
+		return category, nil
+	}
+	for i, template_id := range state.stack {
+		if template_id == id {
+			return nil, &TemplateInheritanceError{
+				Problem:      "Template inherits from itself",
+				Template_ids: append([]int64{}, state.stack[i:]...),
+				Rule_ids:     append([]int64{}, state.rules[i:]...),
+			}
+		}
+	}
+	if len(state.stack) >= max_template_depth {
+		return nil, &TemplateInheritanceError{
+			Problem:      "Template inheritance is nested too deeply",
+			Template_ids: append([]int64{}, state.stack...),
+			Rule_ids:     append([]int64{}, state.rules...),
+		}
+	}
+
 	category := new(DSCategory)
 	err := db.QueryRow(
-		"SELECT id, name FROM ds_category WHERE id = ?",
-		id).Scan(&category.Id, &category.Name)
+		`SELECT id, name, program, catalog_year, effective_from, effective_to
+		FROM ds_category WHERE id = ?`,
+		id).Scan(
+		&category.Id,
+		&category.Name,
+		&category.Program,
+		&category.Catalog_year,
+		&category.Effective_from,
+		&category.Effective_to,
+	)
 	if err != nil {
 		return nil, err
 	}
 	category.Inherits = make([]*DSCategory, 0)
 	category.Classes = make([]*Class, 0)
 	category.Categories = make([]*ClassCategory, 0)
+	category.Rules = make([]*DSCategoryRule, 0)
 
-	err = loadRulesForCategory(db, category)
+	state.stack = append(state.stack, id)
+	err = loadRulesForCategory(db, category, state)
+	state.stack = state.stack[:len(state.stack)-1]
 	if err != nil {
 		return nil, err
 	}
+	state.loaded[id] = category
+	state.order = append(state.order, id)
 	return category, nil
 }
 
+// Load a template inherited by a rule of the template on top of the stack
+func load_inherited_category(db *sql.DB, rule *DSCategoryRule,
+	state *templateLoadState) (*DSCategory, error) {
+	state.inherited_by[rule.Inherit_id.Int64] = append(
+		state.inherited_by[rule.Inherit_id.Int64], rule.Id)
+	state.rules = append(state.rules, rule.Id)
+	category, err := load_ds_category(db, rule.Inherit_id.Int64, state)
+	state.rules = state.rules[:len(state.rules)-1]
+	return category, err
+}
+
 /*
  * A category rule
  */
@@ -334,19 +514,37 @@ type DSCategoryRule struct {
 	Class_id    sql.NullInt64
 	Category_id sql.NullInt64
 	Inherit_id  sql.NullInt64
+
+	// Whether courses taken pass/fail may satisfy the rule. A NULL in the
+	// database places no restriction on the rule.
+	Passfail_allowed bool
+
+	// The amount a RULE_SELECT, RULE_COUNT or RULE_CREDITS rule asks for
+	Min_count   sql.NullInt64
+	Min_credits sql.NullFloat64
+
+	// The lowest letter grade with which a course satisfies the rule
+	Min_grade sql.NullString
+
+	// The objects the rule refers to, resolved when the rule is loaded
+	class          *Class
+	class_category *ClassCategory
+	inherited      *DSCategory
 }
 
 // Load in the rules for a category that has been instantiated with an ID
-func loadRulesForCategory(db *sql.DB, category *DSCategory) error {
+func loadRulesForCategory(db *sql.DB, category *DSCategory, state *templateLoadState) error {
 	rows, err := db.Query(`SELECT id, category, ruletype, class_id, category_id,
-    inherited_id FROM ds_category_rule WHERE category = ?`, category.Id)
+    inherited_id, passfail_allowed, min_count, min_credits, min_grade
+    FROM ds_category_rule WHERE category = ?`, category.Id)
 	if err != nil {
 		return err
 	}
 	defer rows.Close()
 
-	var rule DSCategoryRule
 	for rows.Next() {
+		rule := new(DSCategoryRule)
+		var passfail_allowed sql.NullInt64
 		if err := rows.Scan(
 			&rule.Id,
 			&rule.Category,
@@ -354,39 +552,73 @@ func loadRulesForCategory(db *sql.DB, category *DSCategory) error {
 			&rule.Class_id,
 			&rule.Category_id,
 			&rule.Inherit_id,
+			&passfail_allowed,
+			&rule.Min_count,
+			&rule.Min_credits,
+			&rule.Min_grade,
 		); err != nil {
 			return err
 		}
+		rule.Passfail_allowed = !passfail_allowed.Valid || passfail_allowed.Int64 != 0
+		if err := check_ds_category_rule(rule); err != nil {
+			return err
+		}
 		if rule.Ruletype == RULE_CLASS {
-			if rule.Class_id.Valid {
-				class, err := GetClassById(db, rule.Class_id.Int64)
-				if err != nil {
-					return err
-				}
-				category.Classes = append(category.Classes, class)
-			} else {
-				return errors.New(fmt.Sprintf("Malformed DSCategory rule #%d", rule.Id))
+			class, err := GetClassById(db, rule.Class_id.Int64)
+			if err != nil {
+				return err
 			}
-		} else if rule.Ruletype == RULE_CATEGORY {
-			if rule.Category_id.Valid {
-				class_cat, err := GetClassCategoryById(db, rule.Category_id.Int64)
-				if err != nil {
-					return err
-				}
-				category.Categories = append(category.Categories, class_cat)
-			} else {
-				return errors.New(fmt.Sprintf("Malformed DSCategory rule #%d", rule.Id))
+			category.Classes = append(category.Classes, class)
+			rule.class = class
+		} else if rule.Ruletype == RULE_CATEGORY || rule.Ruletype == RULE_COUNT ||
+			rule.Ruletype == RULE_CREDITS {
+			class_cat, err := GetClassCategoryById(db, rule.Category_id.Int64)
+			if err != nil {
+				return err
 			}
-		} else if rule.Ruletype == RULE_INHERIT {
-			if rule.Inherit_id.Valid {
-				ds_cat, err := GetDSCategoryById(db, rule.Inherit_id.Int64)
-				if err != nil {
-					return err
-				}
-				category.Inherits = append(category.Inherits, ds_cat)
-			} else {
-				return errors.New(fmt.Sprintf("Malformed DSCategory rule #%d", rule.Id))
+			category.Categories = append(category.Categories, class_cat)
+			rule.class_category = class_cat
+		} else if rule.Ruletype == RULE_INHERIT || rule.Ruletype == RULE_SELECT {
+			ds_cat, err := load_inherited_category(db, rule, state)
+			if err != nil {
+				return err
 			}
+			category.Inherits = append(category.Inherits, ds_cat)
+			rule.inherited = ds_cat
+		} else {
+			continue
+		}
+		category.Rules = append(category.Rules, rule)
+	}
+	return nil
+}
+
+// Check that a rule has the fields its ruletype needs
+func check_ds_category_rule(rule *DSCategoryRule) error {
+	malformed := false
+	if rule.Ruletype == RULE_CLASS {
+		malformed = !rule.Class_id.Valid
+	} else if rule.Ruletype == RULE_CATEGORY {
+		malformed = !rule.Category_id.Valid
+	} else if rule.Ruletype == RULE_INHERIT {
+		malformed = !rule.Inherit_id.Valid
+	} else if rule.Ruletype == RULE_SELECT {
+		malformed = !rule.Inherit_id.Valid || !rule.Min_count.Valid
+	} else if rule.Ruletype == RULE_COUNT {
+		malformed = !rule.Category_id.Valid || !rule.Min_count.Valid
+	} else if rule.Ruletype == RULE_CREDITS {
+		malformed = !rule.Category_id.Valid || !rule.Min_credits.Valid
+	}
+	if (rule.Min_count.Valid && rule.Min_count.Int64 <= 0) ||
+		(rule.Min_credits.Valid && rule.Min_credits.Float64 <= 0) {
+		malformed = true
+	}
+	if malformed {
+		return errors.New(fmt.Sprintf("Malformed DSCategory rule #%d", rule.Id))
+	}
+	if rule.Min_grade.Valid {
+		if _, known := ParseGrade(rule.Min_grade.String); !known {
+			return errors.New(fmt.Sprintf("Unknown minimum grade in DSCategory rule #%d", rule.Id))
 		}
 	}
 	return nil
@@ -415,6 +647,7 @@ type DegreeSheet struct {
 	Taken_courses   []*TakenCourse
 	Planned_courses []*PlannedClass
 	Dropped_courses SatisfactionMap
+	Credits         *CreditTotals
 }
 
 func GetDegreeSheetById(db *sql.DB, id int64) (*DegreeSheet, error) {
@@ -451,6 +684,8 @@ func GetDegreeSheetById(db *sql.DB, id int64) (*DegreeSheet, error) {
 		return nil, err
 	}
 
+	sheet.Credits = sheet_credit_totals(sheet)
+
 	return sheet, nil
 }
 
@@ -529,11 +764,15 @@ type PlannedClass struct {
 	Added    time.Time
 	Class_id int64
 	Class    *Class
+	// The term the class is planned for, if chosen yet
+	Year     sql.NullInt64
+	Semester sql.NullInt64
 }
 
 func GetPlannedClassesForUser(db *sql.DB, user_id int64) ([]*PlannedClass, error) {
 	rows, err := db.Query(
-		`SELECT id, added, class_id FROM planned_class WHERE user_id = ?`,
+		`SELECT id, added, class_id, year, semester FROM planned_class
+		WHERE user_id = ? ORDER BY year, semester, id`,
 		user_id,
 	)
 	if err != nil {
@@ -547,7 +786,9 @@ func GetPlannedClassesForUser(db *sql.DB, user_id int64) ([]*PlannedClass, error
 		if err := rows.Scan(
 			&p_c.Id,
 			&p_c.Added,
-			&p_c.Class_id); err != nil {
+			&p_c.Class_id,
+			&p_c.Year,
+			&p_c.Semester); err != nil {
 			return nil, err
 		}
 		p_c.Class, _ = GetClassById(db, p_c.Class_id)
@@ -557,12 +798,28 @@ func GetPlannedClassesForUser(db *sql.DB, user_id int64) ([]*PlannedClass, error
 	return planned_classes, nil
 }
 
-func AddPlannedClassForUser(db *sql.DB, user_id int64, class_id int64) error {
+// Plan a class for a term. Planning a class that is already planned without
+// a term keeps the term it had.
+func AddPlannedClassForUser(db sqlQueryer, user_id int64, class_id int64,
+	year sql.NullInt64, semester sql.NullInt64) error {
+	_, err := db.Exec(
+		`INSERT INTO planned_class (added, user_id, class_id, year, semester)
+		 VALUES (CURRENT_TIMESTAMP(), ?, ?, ?, ?)
+		 ON DUPLICATE KEY UPDATE added = CURRENT_TIMESTAMP(),
+		 year = IFNULL(VALUES(year), year),
+		 semester = IFNULL(VALUES(semester), semester)`,
+		user_id, class_id, year, semester)
+	return err
+}
+
+// Move a planned class to another term. A null year and semester unschedule
+// it.
+func MovePlannedClassForUser(db *sql.DB, user_id int64, class_id int64,
+	year sql.NullInt64, semester sql.NullInt64) error {
 	_, err := db.Exec(
-		`INSERT INTO planned_class (added, user_id, class_id)
-		 VALUES (CURRENT_TIMESTAMP(), ?, ?)
-		 ON DUPLICATE KEY UPDATE added = CURRENT_TIMESTAMP()`,
-		user_id, class_id)
+		`UPDATE planned_class SET year = ?, semester = ?
+		WHERE class_id = ? AND user_id = ?`,
+		year, semester, class_id, user_id)
 	return err
 }
 
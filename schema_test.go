@@ -0,0 +1,96 @@
+package main
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"reflect"
+	"testing"
+)
+
+// A database of templates that only inherit other templates. Template n has
+// rule n*100+i inheriting its i-th entry of inherits.
+func open_inheritance_db(inherits map[int64][]int64) *sql.DB {
+	db, _ := open_test_db(
+		&testResult{pattern: "FROM ds_category WHERE id", answer: func(args []driver.Value) [][]driver.Value {
+			if _, exists := inherits[args[0].(int64)]; !exists {
+				return nil
+			}
+			return [][]driver.Value{{args[0], "Template", nil, nil, nil, nil}}
+		}},
+		&testResult{pattern: "FROM ds_category_rule WHERE category", answer: func(args []driver.Value) [][]driver.Value {
+			id := args[0].(int64)
+			rows := make([][]driver.Value, 0)
+			for i, inherited := range inherits[id] {
+				rows = append(rows, []driver.Value{id*100 + int64(i), id, int64(RULE_INHERIT),
+					nil, nil, inherited, nil, nil, nil, nil})
+			}
+			return rows
+		}},
+	)
+	return db
+}
+
+func TestTemplateInheritance(t *testing.T) {
+	too_deep := make(map[int64][]int64)
+	for id := int64(1); id <= max_template_depth+1; id++ {
+		too_deep[id] = []int64{id + 1}
+	}
+	too_deep[max_template_depth+2] = []int64{}
+	deep_enough := make(map[int64][]int64)
+	for id := int64(1); id < max_template_depth; id++ {
+		deep_enough[id] = []int64{id + 1}
+	}
+	deep_enough[max_template_depth] = []int64{}
+
+	cases := []struct {
+		name     string
+		inherits map[int64][]int64
+		// The templates of the cycle or chain reported, nil if none
+		error_templates []int64
+		error_rules     []int64
+		warnings        int
+	}{
+		{"no inheritance", map[int64][]int64{1: {}}, nil, nil, 0},
+		{"inherits itself", map[int64][]int64{1: {1}}, []int64{1}, []int64{100}, 0},
+		{"cycle", map[int64][]int64{1: {2}, 2: {3}, 3: {2}},
+			[]int64{2, 3}, []int64{200, 300}, 0},
+		{"diamond", map[int64][]int64{1: {2, 3}, 2: {4}, 3: {4}, 4: {}}, nil, nil, 1},
+		{"deep enough", deep_enough, nil, nil, 0},
+		{"too deep", too_deep, []int64{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16},
+			[]int64{100, 200, 300, 400, 500, 600, 700, 800, 900, 1000, 1100, 1200, 1300,
+				1400, 1500, 1600}, 0},
+	}
+	for _, c := range cases {
+		template, err := GetDSCategoryById(open_inheritance_db(c.inherits), 1)
+		if c.error_templates == nil {
+			if err != nil {
+				t.Errorf("%s: %v", c.name, err)
+			} else if len(template.Warnings) != c.warnings {
+				t.Errorf("%s: got warnings %q, want %d", c.name, template.Warnings, c.warnings)
+			}
+			continue
+		}
+		inheritance_err, ok := err.(*TemplateInheritanceError)
+		if !ok {
+			t.Errorf("%s: got error %v, want an inheritance error", c.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(inheritance_err.Template_ids, c.error_templates) ||
+			!reflect.DeepEqual(inheritance_err.Rule_ids, c.error_rules) {
+			t.Errorf("%s: got templates %v rules %v, want %v %v", c.name,
+				inheritance_err.Template_ids, inheritance_err.Rule_ids,
+				c.error_templates, c.error_rules)
+		}
+	}
+}
+
+func TestDiamondInheritanceLoadsOnce(t *testing.T) {
+	template, err := GetDSCategoryById(
+		open_inheritance_db(map[int64][]int64{1: {2, 3}, 2: {4}, 3: {4}, 4: {}}), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if template.Inherits[0].Inherits[0] != template.Inherits[1].Inherits[0] {
+		t.Errorf("shared template loaded twice")
+	}
+}
@@ -0,0 +1,213 @@
+--
+-- Schema changes made since the class_data.sql dump was taken.
+-- Apply in order on top of an existing degreesheep database.
+--
+
+-- --------------------------------------------------------
+
+--
+-- Count and credit based requirement rules
+--
+
+ALTER TABLE `ds_category_rule`
+  ADD `min_count` int(11) DEFAULT NULL,
+  ADD `min_credits` decimal(5,1) DEFAULT NULL;
+
+INSERT INTO `ds_category_ruletype` (`id`, `ruletype`) VALUES
+(8, 'select'),
+(16, 'count'),
+(32, 'credits');
+
+-- --------------------------------------------------------
+
+--
+-- Class category rules matching by subject and course number. A rule with no
+-- class_id matches every class of the subject with a callsign of `subject`
+-- whose course number lies within [number_min, number_max], either bound
+-- being optional. Rules with exclude set remove their class_id from the
+-- category.
+--
+
+ALTER TABLE `class_category_rule`
+  ADD `subject` varchar(16) DEFAULT NULL,
+  ADD `number_min` int(11) DEFAULT NULL,
+  ADD `number_max` int(11) DEFAULT NULL,
+  ADD `exclude` tinyint(4) NOT NULL DEFAULT '0';
+
+-- --------------------------------------------------------
+
+--
+-- Minimum letter grade needed for a course to satisfy a rule
+--
+
+ALTER TABLE `ds_category_rule`
+  ADD `min_grade` varchar(2) DEFAULT NULL;
+
+-- --------------------------------------------------------
+
+--
+-- Catalog year versioning of degree templates. Top level templates carry the
+-- program they belong to (e.g. BSCS) and the catalog year they were written
+-- for. A template applies to students whose studies started between
+-- effective_from and effective_to, or if no dates are set, to students
+-- entering in its catalog year.
+--
+
+ALTER TABLE `ds_category`
+  ADD `program` varchar(64) DEFAULT NULL,
+  ADD `catalog_year` int(11) DEFAULT NULL,
+  ADD `effective_from` date DEFAULT NULL,
+  ADD `effective_to` date DEFAULT NULL;
+
+UPDATE `ds_category` SET `program` = 'BSCS', `catalog_year` = 2015,
+  `effective_from` = '2015-09-01', `effective_to` = '2016-09-01' WHERE `id` = 30;
+
+-- --------------------------------------------------------
+
+--
+-- Limits on the number of courses that may count towards both of two
+-- templates, e.g. a major and a minor. A max_shared of 0 forbids sharing.
+-- Each pair is stored once, with the lower template ID as template_a.
+--
+
+CREATE TABLE IF NOT EXISTS `ds_category_overlap` (
+  `template_a` int(11) NOT NULL,
+  `template_b` int(11) NOT NULL,
+  `max_shared` int(11) NOT NULL,
+  PRIMARY KEY (`template_a`,`template_b`)
+) ENGINE=InnoDB DEFAULT CHARSET=latin1;
+
+-- --------------------------------------------------------
+
+--
+-- Prerequisites and corequisites of classes, as one tree per class. The root
+-- has no parent_id. Nodes of node_type `and` and `or` combine their children,
+-- `class` nodes require required_class_id, optionally with a minimum grade.
+-- Corequisite class nodes may also be taken in the same term.
+--
+
+CREATE TABLE IF NOT EXISTS `class_requisite` (
+  `id` int(11) NOT NULL AUTO_INCREMENT,
+  `class_id` int(11) NOT NULL,
+  `parent_id` int(11) DEFAULT NULL,
+  `node_type` varchar(8) NOT NULL,
+  `required_class_id` int(11) DEFAULT NULL,
+  `min_grade` varchar(2) DEFAULT NULL,
+  `corequisite` tinyint(4) NOT NULL DEFAULT '0',
+  PRIMARY KEY (`id`),
+  KEY `class_id` (`class_id`),
+  KEY `required_class_id` (`required_class_id`)
+) ENGINE=InnoDB DEFAULT CHARSET=latin1;
+
+-- --------------------------------------------------------
+
+--
+-- Catalog data proposed by the -extract-requisites command from class
+-- descriptions, waiting for an editor to accept or reject it. Requisites
+-- proposals hold a JSON requisite tree, former number proposals the subject
+-- callsign and course number a class used to have.
+--
+
+CREATE TABLE IF NOT EXISTS `catalog_proposal` (
+  `id` int(11) NOT NULL AUTO_INCREMENT,
+  `class_id` int(11) NOT NULL,
+  `kind` varchar(16) NOT NULL,
+  `source_text` text NOT NULL,
+  `requisites` text,
+  `former_subject` varchar(16) DEFAULT NULL,
+  `former_number` int(11) DEFAULT NULL,
+  `notes` text NOT NULL,
+  `status` varchar(16) NOT NULL DEFAULT 'pending',
+  PRIMARY KEY (`id`),
+  KEY `status` (`status`)
+) ENGINE=InnoDB DEFAULT CHARSET=latin1;
+
+CREATE TABLE IF NOT EXISTS `class_former_number` (
+  `class_id` int(11) NOT NULL,
+  `subject` varchar(16) NOT NULL,
+  `course_number` int(11) NOT NULL,
+  PRIMARY KEY (`class_id`,`subject`,`course_number`)
+) ENGINE=InnoDB DEFAULT CHARSET=latin1;
+
+-- --------------------------------------------------------
+
+--
+-- The term a planned class is planned for, NULL while unscheduled. Semesters
+-- are numbered in the same way as in taken_courses.
+--
+
+ALTER TABLE `planned_class`
+  ADD `year` int(11) DEFAULT NULL,
+  ADD `semester` int(11) DEFAULT NULL;
+
+-- --------------------------------------------------------
+
+--
+-- Terms in which classes are taught, used when generating plans. Offerings
+-- with no year repeat every year. Classes without any offerings are assumed
+-- to be taught every term.
+--
+
+CREATE TABLE IF NOT EXISTS `class_offering` (
+  `class_id` int(11) NOT NULL,
+  `year` int(11) DEFAULT NULL,
+  `semester` int(11) NOT NULL,
+  KEY `class_id` (`class_id`)
+) ENGINE=InnoDB DEFAULT CHARSET=latin1;
+
+-- --------------------------------------------------------
+
+--
+-- Credits a class is worth. Half credit classes have 0.5, variable credit
+-- classes range from credits up to credits_max.
+--
+
+ALTER TABLE `class`
+  ADD `credits` decimal(4,2) NOT NULL DEFAULT '1.00',
+  ADD `credits_max` decimal(4,2) DEFAULT NULL;
+
+-- --------------------------------------------------------
+
+--
+-- Read-only share tokens for degree sheets. Tokens with no expiry date last
+-- until they are revoked.
+--
+
+CREATE TABLE IF NOT EXISTS `sheet_share` (
+  `token` varchar(64) NOT NULL,
+  `sheet_id` int(11) NOT NULL,
+  `created` datetime NOT NULL,
+  `expires` datetime DEFAULT NULL,
+  `revoked` tinyint(4) NOT NULL DEFAULT '0',
+  PRIMARY KEY (`token`),
+  KEY `sheet_id` (`sheet_id`)
+) ENGINE=InnoDB DEFAULT CHARSET=latin1;
+
+-- --------------------------------------------------------
+
+--
+-- User roles, advisors and their approval of advisees' sheets. Approvals
+-- store a fingerprint of the approved satisfaction mapping or planned
+-- courses, and are only valid while the sheet still matches it.
+--
+
+ALTER TABLE `user`
+  ADD `role` varchar(16) NOT NULL DEFAULT 'student';
+
+CREATE TABLE IF NOT EXISTS `advisor_advisee` (
+  `advisor_id` int(11) NOT NULL,
+  `advisee_id` int(11) NOT NULL,
+  PRIMARY KEY (`advisor_id`,`advisee_id`),
+  KEY `advisee_id` (`advisee_id`)
+) ENGINE=InnoDB DEFAULT CHARSET=latin1;
+
+CREATE TABLE IF NOT EXISTS `sheet_approval` (
+  `id` int(11) NOT NULL AUTO_INCREMENT,
+  `sheet_id` int(11) NOT NULL,
+  `advisor_id` int(11) NOT NULL,
+  `kind` varchar(16) NOT NULL,
+  `approved` datetime NOT NULL,
+  `fingerprint` char(64) NOT NULL,
+  PRIMARY KEY (`id`),
+  KEY `sheet_id` (`sheet_id`)
+) ENGINE=InnoDB DEFAULT CHARSET=latin1;
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"database/sql"
+	_ "github.com/go-sql-driver/mysql"
+	"log"
+	"net/http"
+	"strconv"
+)
+
+type AdvisorServlet struct {
+	db              *sql.DB
+	session_manager *SessionManager
+}
+
+func NewAdvisorServlet(server_config *Config, session_manager *SessionManager) *AdvisorServlet {
+	t := new(AdvisorServlet)
+	t.session_manager = session_manager
+
+	db, err := sql.Open("mysql", server_config.GetSqlURI())
+	if err != nil {
+		log.Fatal("NewAdvisorServlet", "Failed to open database:", err)
+	}
+	t.db = db
+	return t
+}
+
+// Validate the session, and that its user is an advisor if needed
+func (t *AdvisorServlet) get_session(r *http.Request, method string, advisor bool) (*Session, *ApiResult) {
+	session_id := r.Form.Get("session")
+	session_valid, session, err := t.session_manager.GetSession(session_id)
+	if err != nil {
+		log.Println(method, err)
+		return nil, APIError("Internal server error", 500)
+	}
+	if !session_valid {
+		return nil, APIError("The specified session has expired", 401)
+	}
+	if advisor && session.User.Role != ROLE_ADVISOR {
+		return nil, APIError("Only advisors can do this", 401)
+	}
+	return session, nil
+}
+
+// Add an advisor, by username, to the logged in student
+func (t *AdvisorServlet) Add_advisor(r *http.Request) *ApiResult {
+	session, result := t.get_session(r, "Add_advisor", false)
+	if result != nil {
+		return result
+	}
+	advisor, err := GetUserByName(t.db, r.Form.Get("username"))
+	if err == sql.ErrNoRows {
+		return APIError("No such user", 400)
+	}
+	if err != nil {
+		log.Println("Add_advisor", err)
+		return APIError("Internal server error", 500)
+	}
+	if advisor.Role != ROLE_ADVISOR {
+		return APIError("That user is not an advisor", 400)
+	}
+	if err = AddAdvisor(t.db, advisor.Id, session.User.Id); err != nil {
+		log.Println("Add_advisor", err)
+		return APIError("Internal server error", 500)
+	}
+	return APISuccess("OK")
+}
+
+// Remove an advisor, by user ID, from the logged in student
+func (t *AdvisorServlet) Remove_advisor(r *http.Request) *ApiResult {
+	session, result := t.get_session(r, "Remove_advisor", false)
+	if result != nil {
+		return result
+	}
+	advisor_id, err := strconv.ParseInt(r.Form.Get("advisor_id"), 10, 64)
+	if err != nil {
+		return APIError("Bad advisor ID", 400)
+	}
+	if err = RemoveAdvisor(t.db, advisor_id, session.User.Id); err != nil {
+		log.Println("Remove_advisor", err)
+		return APIError("Internal server error", 500)
+	}
+	return APISuccess("OK")
+}
+
+// List the advisors of the logged in student
+func (t *AdvisorServlet) List_advisors(r *http.Request) *ApiResult {
+	session, result := t.get_session(r, "List_advisors", false)
+	if result != nil {
+		return result
+	}
+	advisors, err := GetAdvisors(t.db, session.User.Id)
+	if err != nil {
+		log.Println("List_advisors", err)
+		return APIError("Internal server error", 500)
+	}
+	return APISuccess(advisors)
+}
+
+// List the advisees of the logged in advisor
+func (t *AdvisorServlet) List_advisees(r *http.Request) *ApiResult {
+	session, result := t.get_session(r, "List_advisees", true)
+	if result != nil {
+		return result
+	}
+	advisees, err := GetAdvisees(t.db, session.User.Id)
+	if err != nil {
+		log.Println("List_advisees", err)
+		return APIError("Internal server error", 500)
+	}
+	return APISuccess(advisees)
+}
+
+// List the sheets of an advisee. The sheets themselves can be read with the
+// /degreesheet methods Get_sheet, Get_taken_classes and Audit.
+func (t *AdvisorServlet) List_advisee_sheets(r *http.Request) *ApiResult {
+	session, result := t.get_session(r, "List_advisee_sheets", true)
+	if result != nil {
+		return result
+	}
+	advisee_id, err := strconv.ParseInt(r.Form.Get("advisee_id"), 10, 64)
+	if err != nil {
+		return APIError("Bad advisee ID", 400)
+	}
+	advises, err := IsAdvisorOf(t.db, session.User.Id, advisee_id)
+	if err != nil {
+		log.Println("List_advisee_sheets", err)
+		return APIError("Internal server error", 500)
+	}
+	if !advises {
+		return APIError("You are not an advisor of this user", 401)
+	}
+
+	rows, err := t.db.Query(`
+		SELECT degree_sheet.id, degree_sheet.created, degree_sheet.name,
+			degree_sheet.template_id, ds_category.name
+		FROM degree_sheet, ds_category
+		WHERE ds_category.id = degree_sheet.template_id
+		AND user_id = ?`, advisee_id)
+	if err != nil {
+		log.Println("List_advisee_sheets", err)
+		return APIError("Internal server error", 500)
+	}
+	defer rows.Close()
+	sheet_list := make([]*DegreeSheet, 0)
+	for rows.Next() {
+		sheet := new(DegreeSheet)
+		if err := rows.Scan(
+			&sheet.Id,
+			&sheet.Created,
+			&sheet.Name,
+			&sheet.Template_id,
+			&sheet.Template_name); err != nil {
+			log.Println("List_advisee_sheets", err)
+			return APIError("Internal server error", 500)
+		}
+		sheet.User_id = advisee_id
+		sheet_list = append(sheet_list, sheet)
+	}
+	return APISuccess(sheet_list)
+}
+
+// Sign off an advisee's sheet. kind is "mapping" to approve the satisfaction
+// mapping, or "plan" for the planned courses. fingerprint is the fingerprint
+// of that kind from Get_approvals, and must still match the sheet. The
+// approval stops being valid once the student changes what was approved.
+// Advisors cannot approve their own sheets.
+func (t *AdvisorServlet) Approve(r *http.Request) *ApiResult {
+	session, result := t.get_session(r, "Approve", true)
+	if result != nil {
+		return result
+	}
+	kind := r.Form.Get("kind")
+	if kind != APPROVAL_MAPPING && kind != APPROVAL_PLAN {
+		return APIError("Bad approval kind", 400)
+	}
+	sheet, result := t.advisee_sheet(r, session, "Approve", false)
+	if result != nil {
+		return result
+	}
+
+	fingerprint := r.Form.Get("fingerprint")
+	if fingerprint == "" {
+		return APIError("Missing value for one or more fields", 400)
+	}
+	fingerprints, err := SheetFingerprints(t.db, sheet)
+	if err != nil {
+		return template_load_error("Approve", err)
+	}
+	if fingerprints[kind] != fingerprint {
+		return APIError("The sheet has changed since you viewed it", 400)
+	}
+
+	approval, err := ApproveSheet(t.db, sheet, session.User.Id, kind, fingerprint)
+	if err != nil {
+		log.Println("Approve", err)
+		return APIError("Internal server error", 500)
+	}
+	return APISuccess(approval)
+}
+
+// Get the approvals of a sheet and whether they are still valid, with the
+// fingerprints to approve the sheet as it is now. Available to the owner of
+// the sheet and their advisors.
+func (t *AdvisorServlet) Get_approvals(r *http.Request) *ApiResult {
+	session, result := t.get_session(r, "Get_approvals", false)
+	if result != nil {
+		return result
+	}
+	sheet, result := t.advisee_sheet(r, session, "Get_approvals", true)
+	if result != nil {
+		return result
+	}
+
+	fingerprints, err := SheetFingerprints(t.db, sheet)
+	if err != nil {
+		return template_load_error("Get_approvals", err)
+	}
+	approvals, err := GetApprovalsForSheet(t.db, sheet, fingerprints)
+	if err != nil {
+		log.Println("Get_approvals", err)
+		return APIError("Internal server error", 500)
+	}
+	return APISuccess(approvals)
+}
+
+// Get the sheet named by sheet_id if the session's user advises its owner, or
+// owns it and owner_allowed is set
+func (t *AdvisorServlet) advisee_sheet(r *http.Request, session *Session,
+	method string, owner_allowed bool) (*DegreeSheet, *ApiResult) {
+	sheet_id, err := strconv.ParseInt(r.Form.Get("sheet_id"), 10, 64)
+	if err != nil {
+		return nil, APIError("Bad sheet ID", 400)
+	}
+	sheet, err := GetDegreeSheetById(t.db, sheet_id)
+	if err == sql.ErrNoRows {
+		return nil, APIError("No such sheet", 400)
+	}
+	if err != nil {
+		log.Println(method, err)
+		return nil, APIError("Internal server error", 500)
+	}
+	if sheet.User_id == session.User.Id {
+		if owner_allowed {
+			return sheet, nil
+		}
+		return nil, APIError("You cannot approve your own sheet", 401)
+	}
+	advises, err := IsAdvisorOf(t.db, session.User.Id, sheet.User_id)
+	if err != nil {
+		log.Println(method, err)
+		return nil, APIError("Internal server error", 500)
+	}
+	if !advises {
+		return nil, APIError("You are not an advisor of this user", 401)
+	}
+	return sheet, nil
+}
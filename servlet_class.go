@@ -11,7 +11,9 @@ import (
 	_ "github.com/go-sql-driver/mysql"
 	"log"
 	"net/http"
+	"regexp"
 	"strconv"
+	"strings"
 )
 
 type ClassServlet struct {
@@ -80,6 +82,37 @@ func (t *ClassServlet) CacheableGet(r *http.Request) *ApiResult {
 	return APISuccess(c)
 }
 
+// Return the prerequisite and corequisite tree of a class, or null if it has
+// none
+func (t *ClassServlet) CacheableGet_prerequisites(r *http.Request) *ApiResult {
+	id_s := r.Form.Get("class_id")
+	id, err := strconv.ParseInt(id_s, 10, 64)
+	if err != nil {
+		return APIError("Bad class ID", 400)
+	}
+	requisites, err := GetRequisitesForClass(t.db, id)
+	if err != nil {
+		log.Println("Get_prerequisites", err)
+		return APIError("Internal server error", 500)
+	}
+	return APISuccess(requisites)
+}
+
+// Return the classes that have a class among their requisites
+func (t *ClassServlet) CacheableGet_unlocks(r *http.Request) *ApiResult {
+	id_s := r.Form.Get("class_id")
+	id, err := strconv.ParseInt(id_s, 10, 64)
+	if err != nil {
+		return APIError("Bad class ID", 400)
+	}
+	classes, err := GetClassesUnlockedBy(t.db, id)
+	if err != nil {
+		log.Println("Get_unlocks", err)
+		return APIError("Internal server error", 500)
+	}
+	return APISuccess(classes)
+}
+
 func (t *ClassServlet) CacheableGet_classes_for_category(r *http.Request) *ApiResult {
 	id_s := r.Form.Get("category_id")
 	id, err := strconv.ParseInt(id_s, 10, 64)
@@ -203,7 +236,8 @@ func get_common_classes(class_maps []map[int64]*Class) []*Class {
 // Get a list of all classes in the DB
 func get_all_classes(db *sql.DB) ([]*Class, error) {
 	rows, err := db.Query(`SELECT class.id, class.subject, subject.callsign,
-	subject.description, class.course_number, class.name, class.description FROM class, subject
+	subject.description, class.course_number, class.name, class.description,
+	class.credits, class.credits_max FROM class, subject
     WHERE class.subject = subject.id`)
 
 	if err != nil {
@@ -220,7 +254,9 @@ func get_all_classes(db *sql.DB) ([]*Class, error) {
 			&class.Subject_description,
 			&class.Course_number,
 			&class.Name,
-			&class.Description); err != nil {
+			&class.Description,
+			&class.Credits,
+			&class.Credits_max); err != nil {
 			return nil, err
 		}
 		class_list = append(class_list, class)
@@ -231,7 +267,8 @@ func get_all_classes(db *sql.DB) ([]*Class, error) {
 // Get a map of classid -> class for classes with a given callsign
 func get_classes_by_callsign(db *sql.DB, callsign string) (map[int64]*Class, error) {
 	rows, err := db.Query(`SELECT class.id, class.subject, subject.callsign,
-    class.course_number, class.name, class.description FROM class, subject
+    subject.description, class.course_number, class.name, class.description,
+    class.credits, class.credits_max FROM class, subject
     WHERE class.subject = subject.id
     AND subject.callsign LIKE ?`, callsign)
 
@@ -245,7 +282,8 @@ func get_classes_by_callsign(db *sql.DB, callsign string) (map[int64]*Class, err
 // Get a map of classid -> class for classes with a given callsign
 func get_classes_by_number(db *sql.DB, classnum int64) (map[int64]*Class, error) {
 	rows, err := db.Query(`SELECT class.id, class.subject, subject.callsign,
-    class.course_number, class.name, class.description FROM class, subject
+    subject.description, class.course_number, class.name, class.description,
+    class.credits, class.credits_max FROM class, subject
     WHERE class.subject = subject.id
     AND class.course_number = ?`, classnum)
 
@@ -259,7 +297,8 @@ func get_classes_by_number(db *sql.DB, classnum int64) (map[int64]*Class, error)
 // Get a map of classid -> class for classes with a matching name
 func get_classes_by_name(db *sql.DB, name string) (map[int64]*Class, error) {
 	rows, err := db.Query(`SELECT class.id, class.subject, subject.callsign,
-    class.course_number, class.name, class.description FROM class, subject
+    subject.description, class.course_number, class.name, class.description,
+    class.credits, class.credits_max FROM class, subject
     WHERE class.subject = subject.id
     AND class.name LIKE CONCAT(CONCAT('%',?),'%')`, name)
 
@@ -284,7 +323,9 @@ func scan_class_rows(rows *sql.Rows) (map[int64]*Class, error) {
 			&class.Subject_description,
 			&class.Course_number,
 			&class.Name,
-			&class.Description); err != nil {
+			&class.Description,
+			&class.Credits,
+			&class.Credits_max); err != nil {
 			return nil, err
 		}
 		classes[class.Id] = class
@@ -292,3 +333,91 @@ func scan_class_rows(rows *sql.Rows) (map[int64]*Class, error) {
 
 	return classes, nil
 }
+
+var class_name_pattern = regexp.MustCompile(`^\s*([A-Za-z]+)\s*-?\s*(\d+)\s*$`)
+
+// Split a class name like "COMP 15" into its subject callsign and course
+// number. Returns false if the name isn't of that form.
+func parse_class_name(name string) (string, int64, bool) {
+	match := class_name_pattern.FindStringSubmatch(name)
+	if match == nil {
+		return "", 0, false
+	}
+	number, err := strconv.ParseInt(match[2], 10, 64)
+	if err != nil {
+		return "", 0, false
+	}
+	return strings.ToUpper(match[1]), number, true
+}
+
+// Get the ID of a class by subject callsign and course number
+func get_class_id_by_callsign(db sqlQueryer, callsign string, number int64) (int64, error) {
+	var class_id int64
+	err := db.QueryRow(`SELECT class.id FROM class, subject
+	WHERE class.subject = subject.id AND subject.callsign = ?
+	AND class.course_number = ?`, callsign, number).Scan(&class_id)
+	return class_id, err
+}
+
+func (t *ClassServlet) check_catalog_editor(r *http.Request, method string) *ApiResult {
+	session_id := r.Form.Get("session")
+	session_valid, session, err := t.session_manager.GetSession(session_id)
+	if err != nil {
+		log.Println(method, err)
+		return APIError("Internal server error", 500)
+	}
+	if !session_valid {
+		return APIError("The specified session has expired", 401)
+	}
+	for _, editor := range t.server_config.Catalog.Editor {
+		if editor == session.User.Username {
+			return nil
+		}
+	}
+	return APIError("You are not allowed to edit the catalog", 401)
+}
+
+// List the prerequisites and former numbers proposed by -extract-requisites
+// that have not been reviewed yet
+func (t *ClassServlet) List_proposals(r *http.Request) *ApiResult {
+	if result := t.check_catalog_editor(r, "List_proposals"); result != nil {
+		return result
+	}
+	status := r.Form.Get("status")
+	if status == "" {
+		status = PROPOSAL_PENDING
+	}
+	proposals, err := GetCatalogProposals(t.db, status)
+	if err != nil {
+		log.Println("List_proposals", err)
+		return APIError("Internal server error", 500)
+	}
+	return APISuccess(proposals)
+}
+
+// Accept (accept=1) or reject a proposal
+func (t *ClassServlet) Review_proposal(r *http.Request) *ApiResult {
+	if result := t.check_catalog_editor(r, "Review_proposal"); result != nil {
+		return result
+	}
+	proposal_id, err := strconv.ParseInt(r.Form.Get("proposal_id"), 10, 64)
+	if err != nil {
+		return APIError("Bad proposal ID", 400)
+	}
+
+	err = ReviewCatalogProposal(t.db, proposal_id, r.Form.Get("accept") == "1")
+	if err == sql.ErrNoRows {
+		return APIError("No such proposal", 400)
+	}
+	if reviewed_err, ok := err.(*ProposalReviewedError); ok {
+		return APIError(reviewed_err.Error(), 400)
+	}
+	if empty_err, ok := err.(*ProposalEmptyError); ok {
+		return APIError(empty_err.Error(), 400)
+	}
+	if err != nil {
+		log.Println("Review_proposal", err)
+		return APIError("Internal server error", 500)
+	}
+	return APISuccess("OK")
+}
@@ -2,12 +2,16 @@ package main
 
 import (
 	"database/sql"
+	"encoding/csv"
 	"encoding/json"
 	"fmt"
 	_ "github.com/go-sql-driver/mysql"
 	"log"
+	"math"
 	"net/http"
 	"strconv"
+	"strings"
+	"time"
 )
 
 type DegreeSheetServlet struct {
@@ -124,7 +128,24 @@ func (t *DegreeSheetServlet) Add_entry(r *http.Request) *ApiResult {
 		return APIError("Internal server error", 500)
 	}
 
-	return APISuccess("OK")
+	// Warn if the course was taken before its prerequisites were completed
+	warnings := make([]string, 0)
+	class_id_i, class_err := strconv.ParseInt(class_id, 10, 64)
+	year_i, year_err := strconv.ParseInt(year, 10, 64)
+	semester_i, semester_err := strconv.ParseInt(semester, 10, 64)
+	if class_err == nil && year_err == nil && semester_err == nil {
+		// The course is already saved, so failing to check it is only logged
+		taken, err := GetTakenCoursesForUser(t.db, session.User.Id)
+		if err == nil {
+			warnings, err = check_requisites(t.db, class_id_i,
+				term_index(year_i, semester_i), taken_completions(taken))
+		}
+		if err != nil {
+			log.Println("Add_entry", err)
+			return APISuccess("OK")
+		}
+	}
+	return APISuccessWithWarnings("OK", warnings)
 }
 
 func (t *DegreeSheetServlet) List_sheets(r *http.Request) *ApiResult {
@@ -187,45 +208,65 @@ func (t *DegreeSheetServlet) Set_satisfaction_mapping(r *http.Request) *ApiResul
 	}
 
 	degree_sheet, err := GetDegreeSheetById(t.db, sheet_id)
+	if err != nil {
+		log.Println("Set_satisfaction_mapping", err)
+		return APIError("Internal server error", 500)
+	}
 	if degree_sheet.User_id != session.User.Id {
 		return APIError("Specified sheet is not owned by you", 401)
 	}
 
 	// Check that the input is valid
 	map_json := r.Form.Get("satisfaction_map")
-	sat_map := make(map[string]int)
+	sat_map := make(SatisfactionMap)
 	err = json.Unmarshal([]byte(map_json), &sat_map)
 	if err != nil {
 		log.Println(err)
 		return APIError("Invalid satisfaction map", 400)
 	}
 
-	// Drop all mappings for the given sheet
-	t.db.Exec("DELETE FROM degree_sheet_entry WHERE sheet_id = ?", degree_sheet.Id)
+	// Check the mapping against the sheet's template and courses
+	template, err := GetDSCategoryById(t.db, degree_sheet.Template_id)
+	if err != nil {
+		return template_load_error("Set_satisfaction_mapping", err)
+	}
+	map_errors := ValidateSatisfactionMap(template, degree_sheet.Taken_courses, sat_map)
+	if len(map_errors) > 0 {
+		return APIErrorWithData("Invalid satisfaction map", 400, map_errors)
+	}
 
-	// Add mappings for the sheet using the map we were passed in
+	// Replace the mappings for the sheet with the map we were passed in
+	tx, err := t.db.Begin()
+	if err != nil {
+		log.Println("Set_satisfaction_mapping", err)
+		return APIError("Internal server error", 500)
+	}
+	_, err = tx.Exec("DELETE FROM degree_sheet_entry WHERE sheet_id = ?", degree_sheet.Id)
+	if err != nil {
+		tx.Rollback()
+		log.Println("Set_satisfaction_mapping", err)
+		return APIError("Internal server error", 500)
+	}
 	for requirement_id, satisfier_id := range sat_map {
-		t.db.Exec(
+		_, err = tx.Exec(
 			`INSERT INTO degree_sheet_entry
 			(sheet_id, requirement_id, satisfier_id)
 			VALUES (?, ?, ?)`,
 			degree_sheet.Id, requirement_id, satisfier_id)
+		if err != nil {
+			tx.Rollback()
+			log.Println("Set_satisfaction_mapping", err)
+			return APIError("Internal server error", 500)
+		}
+	}
+	if err = tx.Commit(); err != nil {
+		log.Println("Set_satisfaction_mapping", err)
+		return APIError("Internal server error", 500)
 	}
 	return APISuccess("OK")
 }
 
 func (t *DegreeSheetServlet) Get_taken_classes(r *http.Request) *ApiResult {
-	session_id := r.Form.Get("session")
-	session_valid, session, err := t.session_manager.GetSession(session_id)
-
-	if err != nil {
-		log.Println("Get_entries", err)
-		return APIError("Internal server error", 500)
-	}
-	if !session_valid {
-		return APIError("The specified session has expired", 401)
-	}
-
 	entry_list := make([]*TakenCourse, 0)
 
 	sheet_id_s := r.Form.Get("sheet_id")
@@ -242,9 +283,8 @@ func (t *DegreeSheetServlet) Get_taken_classes(r *http.Request) *ApiResult {
 			return APIError("Internal server error", 500)
 		}
 	}
-	if sheet.User_id != session.User.Id {
-		log.Println("Get_entries", err)
-		return APIError("Unauthorized", 401)
+	if result := t.check_sheet_reader(r, sheet, "Get_entries"); result != nil {
+		return result
 	}
 
 	rows, err := t.db.Query(
@@ -341,6 +381,32 @@ func (t *DegreeSheetServlet) Add_sheet(r *http.Request) *ApiResult {
 	}
 	name := r.Form.Get("name")
 	template_id := r.Form.Get("template_id")
+	program := r.Form.Get("program")
+
+	// Without a template, use the version of the program that applies to the
+	// user's class year
+	if template_id == "" && program != "" {
+		class_year, err := strconv.ParseInt(session.User.Class_year, 10, 64)
+		if err != nil {
+			return APIError("Your class year is not set", 400)
+		}
+		templates, err := GetTemplatesForClassYear(t.db, class_year, program)
+		if err != nil {
+			log.Println("Add_sheet", err)
+			return APIError("Internal server error", 500)
+		}
+		if len(templates) == 0 {
+			return APIError(fmt.Sprintf("No %s template applies to the class of %d",
+				program, class_year), 400)
+		}
+		latest := templates[0]
+		for _, template := range templates {
+			if template.Catalog_year.Int64 > latest.Catalog_year.Int64 {
+				latest = template
+			}
+		}
+		template_id = strconv.FormatInt(latest.Id, 10)
+	}
 
 	if name == "" || template_id == "" {
 		log.Println("Add_sheet", err)
@@ -357,16 +423,6 @@ func (t *DegreeSheetServlet) Add_sheet(r *http.Request) *ApiResult {
 }
 
 func (t *DegreeSheetServlet) Get_sheet(r *http.Request) *ApiResult {
-	session_id := r.Form.Get("session")
-	session_valid, session, err := t.session_manager.GetSession(session_id)
-	if err != nil {
-		log.Println("Add_sheet", err)
-		return APIError("Internal server error", 500)
-	}
-	if !session_valid {
-		return APIError("The specified session has expired", 401)
-	}
-
 	sheet_id_s := r.Form.Get("sheet_id")
 	sheet_id, err := strconv.ParseInt(sheet_id_s, 10, 64)
 	if err != nil {
@@ -374,8 +430,12 @@ func (t *DegreeSheetServlet) Get_sheet(r *http.Request) *ApiResult {
 	}
 
 	degree_sheet, err := GetDegreeSheetById(t.db, sheet_id)
-	if degree_sheet.User_id != session.User.Id {
-		return APIError("Specified sheet is not owned by you", 401)
+	if err != nil {
+		log.Println("Get_sheet", err)
+		return APIError("Internal server error", 500)
+	}
+	if result := t.check_sheet_reader(r, degree_sheet, "Get_sheet"); result != nil {
+		return result
 	}
 
 	return APISuccess(degree_sheet)
@@ -405,14 +465,27 @@ func (t *DegreeSheetServlet) Remove_sheet(r *http.Request) *ApiResult {
 		log.Println("Remove_sheet", err)
 		return APIError("Unauthorized", 401)
 	}
-	_, err = t.db.Exec("DELETE FROM degree_sheet WHERE id = ?", sheet_id)
+	// Remove the sheet together with its mappings, share links and approvals
+	tx, err := t.db.Begin()
 	if err != nil {
 		log.Println("Remove_sheet", err)
 		return APIError("Internal server error", 500)
 	}
-	_, err = t.db.Exec("DELETE FROM degree_sheet_entries WHERE sheet_id = ?",
-		sheet_id)
+	for _, table := range []string{"degree_sheet_entry", "sheet_share", "sheet_approval"} {
+		_, err = tx.Exec("DELETE FROM "+table+" WHERE sheet_id = ?", sheet_id)
+		if err != nil {
+			tx.Rollback()
+			log.Println("Remove_sheet", err)
+			return APIError("Internal server error", 500)
+		}
+	}
+	_, err = tx.Exec("DELETE FROM degree_sheet WHERE id = ?", sheet_id)
 	if err != nil {
+		tx.Rollback()
+		log.Println("Remove_sheet", err)
+		return APIError("Internal server error", 500)
+	}
+	if err = tx.Commit(); err != nil {
 		log.Println("Remove_sheet", err)
 		return APIError("Internal server error", 500)
 	}
@@ -456,13 +529,140 @@ func (t *DegreeSheetServlet) Add_planned_course(r *http.Request) *ApiResult {
 		return APIError("Invalid course ID", 400)
 	}
 
-	err = AddPlannedClassForUser(t.db, session.User.Id, course_id)
+	year, semester, term_err := form_term(r, "")
+	if term_err != nil {
+		return term_err
+	}
+
+	err = AddPlannedClassForUser(t.db, session.User.Id, course_id, year, semester)
 	if err != nil {
 		log.Println(err)
 		return APIError("Internal server error", 500)
 	}
 
-	return APISuccess("OK")
+	// The course is already saved, so failing to check it is only logged
+	warnings, err := t.check_planned_requisites(session.User.Id, course_id, year, semester)
+	if err != nil {
+		log.Println("Add_planned_course", err)
+		return APISuccess("OK")
+	}
+	return APISuccessWithWarnings("OK", warnings)
+}
+
+// Move a planned course to another term, given by year and semester. Leaving
+// both empty unschedules the course.
+func (t *DegreeSheetServlet) Move_planned_course(r *http.Request) *ApiResult {
+	session_id := r.Form.Get("session")
+	session_valid, session, err := t.session_manager.GetSession(session_id)
+	if err != nil {
+		log.Println("Move_planned_course", err)
+		return APIError("Internal server error", 500)
+	}
+	if !session_valid {
+		return APIError("The specified session has expired", 401)
+	}
+
+	course_id_s := r.Form.Get("course_id")
+	course_id, err := strconv.ParseInt(course_id_s, 10, 64)
+	if err != nil {
+		return APIError("Invalid course ID", 400)
+	}
+	year, semester, term_err := form_term(r, "")
+	if term_err != nil {
+		return term_err
+	}
+
+	planned, err := GetPlannedClassesForUser(t.db, session.User.Id)
+	if err != nil {
+		log.Println("Move_planned_course", err)
+		return APIError("Internal server error", 500)
+	}
+	is_planned := false
+	for _, planned_class := range planned {
+		if planned_class.Class_id == course_id {
+			is_planned = true
+		}
+	}
+	if !is_planned {
+		return APIError("That course is not planned", 400)
+	}
+
+	err = MovePlannedClassForUser(t.db, session.User.Id, course_id, year, semester)
+	if err != nil {
+		log.Println("Move_planned_course", err)
+		return APIError("Internal server error", 500)
+	}
+
+	// The course is already saved, so failing to check it is only logged
+	warnings, err := t.check_planned_requisites(session.User.Id, course_id, year, semester)
+	if err != nil {
+		log.Println("Move_planned_course", err)
+		return APISuccess("OK")
+	}
+	return APISuccessWithWarnings("OK", warnings)
+}
+
+// Get the user's planned courses grouped by term, with per-term totals
+func (t *DegreeSheetServlet) Get_plan(r *http.Request) *ApiResult {
+	session_id := r.Form.Get("session")
+	session_valid, session, err := t.session_manager.GetSession(session_id)
+	if err != nil {
+		log.Println("Get_plan", err)
+		return APIError("Internal server error", 500)
+	}
+	if !session_valid {
+		return APIError("The specified session has expired", 401)
+	}
+
+	planned, err := GetPlannedClassesForUser(t.db, session.User.Id)
+	if err != nil {
+		log.Println("Get_plan", err)
+		return APIError("Internal server error", 500)
+	}
+	return APISuccess(GroupPlanByTerm(planned))
+}
+
+// Warn about the prerequisites of a planned course that are neither taken
+// nor planned for an earlier term
+func (t *DegreeSheetServlet) check_planned_requisites(user_id int64, class_id int64,
+	year sql.NullInt64, semester sql.NullInt64) ([]string, error) {
+	taken, err := GetTakenCoursesForUser(t.db, user_id)
+	if err != nil {
+		return nil, err
+	}
+	planned, err := GetPlannedClassesForUser(t.db, user_id)
+	if err != nil {
+		return nil, err
+	}
+	term := int64(math.MaxInt64)
+	if year.Valid && semester.Valid {
+		term = term_index(year.Int64, semester.Int64)
+	}
+	completions := append(taken_completions(taken), planned_completions(planned)...)
+	return check_requisites(t.db, class_id, term, completions)
+}
+
+// Read an optional term from the form values <prefix>year and
+// <prefix>semester, e.g. the term of a planned course. Either both or neither
+// must be given.
+func form_term(r *http.Request, prefix string) (sql.NullInt64, sql.NullInt64, *ApiResult) {
+	year_s := r.Form.Get(prefix + "year")
+	semester_s := r.Form.Get(prefix + "semester")
+	if year_s == "" && semester_s == "" {
+		return sql.NullInt64{}, sql.NullInt64{}, nil
+	}
+	label := strings.Replace(prefix, "_", " ", -1)
+	year, err := strconv.ParseInt(year_s, 10, 64)
+	if err != nil {
+		return sql.NullInt64{}, sql.NullInt64{}, APIError(fmt.Sprintf("Bad %syear", label), 400)
+	}
+	semester, err := strconv.ParseInt(semester_s, 10, 64)
+	if err != nil || semester < 1 || semester > semesters_per_year {
+		return sql.NullInt64{}, sql.NullInt64{},
+			APIError(fmt.Sprintf("Bad %ssemester", label), 400)
+	}
+	return sql.NullInt64{Int64: year, Valid: true},
+		sql.NullInt64{Int64: semester, Valid: true}, nil
 }
 
 func (t *DegreeSheetServlet) Delete_planned_course(r *http.Request) *ApiResult {
@@ -497,9 +697,670 @@ func (t *DegreeSheetServlet) CacheableGet_requirements_for_template(r *http.Requ
 		return APIError("Bad template ID", 400)
 	}
 	degree_template, err := GetDSCategoryById(t.db, template_id)
+	if err == sql.ErrNoRows {
+		return APIError("No such template", 400)
+	}
 	if err != nil {
-		log.Println(err)
-		return APIError("Internal Server Error", 500)
+		return template_load_error("Get_requirements_for_template", err)
+	}
+	return APISuccessWithWarnings(degree_template, degree_template.Warnings)
+}
+
+// Audit a degree sheet against its template, reporting which requirements are
+// satisfied and by which taken course.
+func (t *DegreeSheetServlet) Audit(r *http.Request) *ApiResult {
+	sheet_id_s := r.Form.Get("sheet_id")
+	sheet_id, err := strconv.ParseInt(sheet_id_s, 10, 64)
+	if err != nil {
+		return APIError("Bad sheet ID", 400)
+	}
+	sheet, err := GetDegreeSheetById(t.db, sheet_id)
+	if err != nil {
+		log.Println("Audit", err)
+		return APIError("Internal server error", 500)
+	}
+	if result := t.check_sheet_reader(r, sheet, "Audit"); result != nil {
+		return result
+	}
+
+	audit, err := AuditDegreeSheet(t.db, sheet)
+	if err != nil {
+		return template_load_error("Audit", err)
+	}
+	return APISuccess(audit)
+}
+
+// Propose a satisfaction mapping for a sheet that satisfies as many
+// requirements as possible. The mapping is not saved; clients may pass it
+// (or a modified version) to Set_satisfaction_mapping.
+func (t *DegreeSheetServlet) Propose_satisfaction_mapping(r *http.Request) *ApiResult {
+	session_id := r.Form.Get("session")
+	session_valid, session, err := t.session_manager.GetSession(session_id)
+	if err != nil {
+		log.Println("Propose_satisfaction_mapping", err)
+		return APIError("Internal server error", 500)
+	}
+	if !session_valid {
+		return APIError("The specified session has expired", 401)
+	}
+
+	sheet_id_s := r.Form.Get("sheet_id")
+	sheet_id, err := strconv.ParseInt(sheet_id_s, 10, 64)
+	if err != nil {
+		return APIError("Bad sheet ID", 400)
+	}
+	sheet, err := GetDegreeSheetById(t.db, sheet_id)
+	if err != nil {
+		log.Println("Propose_satisfaction_mapping", err)
+		return APIError("Internal server error", 500)
+	}
+	if sheet.User_id != session.User.Id {
+		return APIError("Specified sheet is not owned by you", 401)
+	}
+
+	template, err := GetDSCategoryById(t.db, sheet.Template_id)
+	if err != nil {
+		return template_load_error("Propose_satisfaction_mapping", err)
+	}
+
+	// Only start from the saved mapping if asked to, otherwise propose the
+	// optimal mapping from scratch.
+	saved_map := make(SatisfactionMap)
+	if r.Form.Get("keep_saved") == "1" {
+		saved_map = sheet.Dropped_courses
+	}
+	return APISuccess(ProposeSatisfactionMap(template, sheet.Taken_courses, saved_map))
+}
+
+// List the templates that apply to the user's class year, optionally only
+// those of one program
+func (t *DegreeSheetServlet) List_templates(r *http.Request) *ApiResult {
+	session_id := r.Form.Get("session")
+	session_valid, session, err := t.session_manager.GetSession(session_id)
+	if err != nil {
+		log.Println("List_templates", err)
+		return APIError("Internal server error", 500)
+	}
+	if !session_valid {
+		return APIError("The specified session has expired", 401)
+	}
+
+	class_year, err := strconv.ParseInt(session.User.Class_year, 10, 64)
+	if err != nil {
+		return APIError("Your class year is not set", 400)
+	}
+	templates, err := GetTemplatesForClassYear(t.db, class_year, r.Form.Get("program"))
+	if err != nil {
+		log.Println("List_templates", err)
+		return APIError("Internal server error", 500)
+	}
+	return APISuccess(templates)
+}
+
+// Move a sheet to another template, e.g. after a change of major or catalog
+// year. Satisfaction mappings are carried over where the new template has the
+// same requirement; the ones that could not be are reported.
+func (t *DegreeSheetServlet) Change_template(r *http.Request) *ApiResult {
+	session_id := r.Form.Get("session")
+	session_valid, session, err := t.session_manager.GetSession(session_id)
+	if err != nil {
+		log.Println("Change_template", err)
+		return APIError("Internal server error", 500)
+	}
+	if !session_valid {
+		return APIError("The specified session has expired", 401)
+	}
+
+	sheet_id_s := r.Form.Get("sheet_id")
+	sheet_id, err := strconv.ParseInt(sheet_id_s, 10, 64)
+	if err != nil {
+		return APIError("Bad sheet ID", 400)
+	}
+	template_id_s := r.Form.Get("template_id")
+	template_id, err := strconv.ParseInt(template_id_s, 10, 64)
+	if err != nil {
+		return APIError("Bad template ID", 400)
+	}
+	sheet, err := GetDegreeSheetById(t.db, sheet_id)
+	if err != nil {
+		log.Println("Change_template", err)
+		return APIError("Internal server error", 500)
+	}
+	if sheet.User_id != session.User.Id {
+		return APIError("Specified sheet is not owned by you", 401)
+	}
+
+	old_template, err := GetDSCategoryById(t.db, sheet.Template_id)
+	if err != nil {
+		return template_load_error("Change_template", err)
+	}
+	new_template, err := GetDSCategoryById(t.db, template_id)
+	if err == sql.ErrNoRows {
+		return APIError("No such template", 400)
+	}
+	if err != nil {
+		return template_load_error("Change_template", err)
+	}
+
+	migration := MigrateSatisfactionMap(old_template, new_template,
+		sheet.Taken_courses, sheet.Dropped_courses)
+
+	tx, err := t.db.Begin()
+	if err != nil {
+		log.Println("Change_template", err)
+		return APIError("Internal server error", 500)
+	}
+	_, err = tx.Exec("UPDATE degree_sheet SET template_id = ? WHERE id = ?",
+		new_template.Id, sheet.Id)
+	if err != nil {
+		tx.Rollback()
+		log.Println("Change_template", err)
+		return APIError("Internal server error", 500)
+	}
+	_, err = tx.Exec("DELETE FROM degree_sheet_entry WHERE sheet_id = ?", sheet.Id)
+	if err != nil {
+		tx.Rollback()
+		log.Println("Change_template", err)
+		return APIError("Internal server error", 500)
+	}
+	for requirement_id, satisfier_id := range migration.Satisfaction_map {
+		_, err = tx.Exec(
+			`INSERT INTO degree_sheet_entry
+			(sheet_id, requirement_id, satisfier_id)
+			VALUES (?, ?, ?)`,
+			sheet.Id, requirement_id, satisfier_id)
+		if err != nil {
+			tx.Rollback()
+			log.Println("Change_template", err)
+			return APIError("Internal server error", 500)
+		}
+	}
+	if err = tx.Commit(); err != nil {
+		log.Println("Change_template", err)
+		return APIError("Internal server error", 500)
+	}
+	return APISuccess(migration)
+}
+
+// Audit the user's taken and planned courses against any template, without
+// needing a degree sheet for it, e.g. to see how far off a minor is.
+func (t *DegreeSheetServlet) Audit_template(r *http.Request) *ApiResult {
+	session_id := r.Form.Get("session")
+	session_valid, session, err := t.session_manager.GetSession(session_id)
+	if err != nil {
+		log.Println("Audit_template", err)
+		return APIError("Internal server error", 500)
+	}
+	if !session_valid {
+		return APIError("The specified session has expired", 401)
 	}
-	return APISuccess(degree_template)
+
+	template_id_s := r.Form.Get("template_id")
+	template_id, err := strconv.ParseInt(template_id_s, 10, 64)
+	if err != nil {
+		return APIError("Bad template ID", 400)
+	}
+	template, err := GetDSCategoryById(t.db, template_id)
+	if err == sql.ErrNoRows {
+		return APIError("No such template", 400)
+	}
+	if err != nil {
+		return template_load_error("Audit_template", err)
+	}
+
+	taken, err := GetTakenCoursesForUser(t.db, session.User.Id)
+	if err != nil {
+		log.Println("Audit_template", err)
+		return APIError("Internal server error", 500)
+	}
+	planned, err := GetPlannedClassesForUser(t.db, session.User.Id)
+	if err != nil {
+		log.Println("Audit_template", err)
+		return APIError("Internal server error", 500)
+	}
+	return APISuccess(AuditTemplate(template, taken, planned, make(SatisfactionMap)))
+}
+
+// Audit all of the user's sheets together, flagging courses that count
+// towards more of them than the templates' overlap policies allow. The flags
+// are advisory: each sheet is audited on its own, so sharing that a different
+// satisfaction map would avoid is flagged too.
+func (t *DegreeSheetServlet) Audit_all(r *http.Request) *ApiResult {
+	session_id := r.Form.Get("session")
+	session_valid, session, err := t.session_manager.GetSession(session_id)
+	if err != nil {
+		log.Println("Audit_all", err)
+		return APIError("Internal server error", 500)
+	}
+	if !session_valid {
+		return APIError("The specified session has expired", 401)
+	}
+
+	rows, err := t.db.Query("SELECT id FROM degree_sheet WHERE user_id = ? ORDER BY id",
+		session.User.Id)
+	if err != nil {
+		log.Println("Audit_all", err)
+		return APIError("Internal server error", 500)
+	}
+	sheet_ids := make([]int64, 0)
+	for rows.Next() {
+		var sheet_id int64
+		if err := rows.Scan(&sheet_id); err != nil {
+			rows.Close()
+			log.Println("Audit_all", err)
+			return APIError("Internal server error", 500)
+		}
+		sheet_ids = append(sheet_ids, sheet_id)
+	}
+	rows.Close()
+
+	sheets := make([]*DegreeSheet, 0)
+	for _, sheet_id := range sheet_ids {
+		sheet, err := GetDegreeSheetById(t.db, sheet_id)
+		if err != nil {
+			log.Println("Audit_all", err)
+			return APIError("Internal server error", 500)
+		}
+		sheets = append(sheets, sheet)
+	}
+
+	combined, err := AuditSheets(t.db, sheets)
+	if err != nil {
+		return template_load_error("Audit_all", err)
+	}
+	return APISuccess(combined)
+}
+
+// Propose a term by term plan for the unsatisfied requirements of a sheet.
+// Params:
+//   - Valid session
+//   - Sheet ID
+//   - Optionally max_per_term, the most courses to plan in a term (default 4)
+//   - Optionally the first term to plan, start_year and start_semester
+//     (default the term after the last taken course, or the current term)
+//   - Optionally the graduation term, graduation_year and graduation_semester
+//     (default the spring of the user's class year)
+//
+// Nothing is saved; the proposed courses can be passed to Accept_plan.
+func (t *DegreeSheetServlet) Generate_plan(r *http.Request) *ApiResult {
+	session_id := r.Form.Get("session")
+	session_valid, session, err := t.session_manager.GetSession(session_id)
+	if err != nil {
+		log.Println("Generate_plan", err)
+		return APIError("Internal server error", 500)
+	}
+	if !session_valid {
+		return APIError("The specified session has expired", 401)
+	}
+
+	sheet_id_s := r.Form.Get("sheet_id")
+	sheet_id, err := strconv.ParseInt(sheet_id_s, 10, 64)
+	if err != nil {
+		return APIError("Bad sheet ID", 400)
+	}
+	sheet, err := GetDegreeSheetById(t.db, sheet_id)
+	if err != nil {
+		log.Println("Generate_plan", err)
+		return APIError("Internal server error", 500)
+	}
+	if sheet.User_id != session.User.Id {
+		return APIError("Specified sheet is not owned by you", 401)
+	}
+
+	options := &PlanOptions{Max_per_term: 4}
+	if r.Form.Get("max_per_term") != "" {
+		options.Max_per_term, err = strconv.ParseInt(r.Form.Get("max_per_term"), 10, 64)
+		if err != nil || options.Max_per_term < 1 {
+			return APIError("Bad maximum number of courses per term", 400)
+		}
+	}
+
+	options.Start_year, options.Start_semester = current_term(time.Now())
+	for _, course := range sheet.Taken_courses {
+		if term_index(course.Year, course.Semester) >=
+			term_index(options.Start_year, options.Start_semester) {
+			options.Start_year, options.Start_semester = next_term(course.Year, course.Semester)
+		}
+	}
+	start_year, start_semester, term_err := form_term(r, "start_")
+	if term_err != nil {
+		return term_err
+	}
+	if start_year.Valid {
+		options.Start_year, options.Start_semester = start_year.Int64, start_semester.Int64
+	}
+
+	graduation_year, graduation_semester, term_err := form_term(r, "graduation_")
+	if term_err != nil {
+		return term_err
+	}
+	if graduation_year.Valid {
+		options.Graduation_year = graduation_year.Int64
+		options.Graduation_semester = graduation_semester.Int64
+	} else {
+		options.Graduation_year, err = strconv.ParseInt(session.User.Class_year, 10, 64)
+		if err != nil {
+			return APIError("Your class year is not set", 400)
+		}
+		options.Graduation_semester = 1
+	}
+
+	plan, err := GeneratePlan(t.db, sheet, options)
+	if err != nil {
+		return template_load_error("Generate_plan", err)
+	}
+	return APISuccess(plan)
+}
+
+// Save planned courses, e.g. from Generate_plan. plan is a JSON list of
+// objects with Class_id, Year and Semester as plain numbers. Courses that are
+// already planned are moved to the given term. Nothing is saved unless every
+// course in the plan is valid.
+func (t *DegreeSheetServlet) Accept_plan(r *http.Request) *ApiResult {
+	session_id := r.Form.Get("session")
+	session_valid, session, err := t.session_manager.GetSession(session_id)
+	if err != nil {
+		log.Println("Accept_plan", err)
+		return APIError("Internal server error", 500)
+	}
+	if !session_valid {
+		return APIError("The specified session has expired", 401)
+	}
+
+	planned := make([]struct {
+		Class_id int64
+		Year     int64
+		Semester int64
+	}, 0)
+	if err = json.Unmarshal([]byte(r.Form.Get("plan")), &planned); err != nil {
+		return APIError("Invalid plan", 400)
+	}
+
+	// Check the whole plan before saving any of it
+	for _, planned_class := range planned {
+		if planned_class.Semester < 1 || planned_class.Semester > semesters_per_year {
+			return APIError(fmt.Sprintf("Bad semester for class #%d", planned_class.Class_id), 400)
+		}
+		_, err = GetClassById(t.db, planned_class.Class_id)
+		if err == sql.ErrNoRows {
+			return APIError(fmt.Sprintf("No class #%d", planned_class.Class_id), 400)
+		}
+		if err != nil {
+			log.Println("Accept_plan", err)
+			return APIError("Internal server error", 500)
+		}
+	}
+
+	tx, err := t.db.Begin()
+	if err != nil {
+		log.Println("Accept_plan", err)
+		return APIError("Internal server error", 500)
+	}
+	for _, planned_class := range planned {
+		err = AddPlannedClassForUser(tx, session.User.Id, planned_class.Class_id,
+			sql.NullInt64{Int64: planned_class.Year, Valid: true},
+			sql.NullInt64{Int64: planned_class.Semester, Valid: true})
+		if err != nil {
+			tx.Rollback()
+			log.Println("Accept_plan", err)
+			return APIError("Internal server error", 500)
+		}
+	}
+	if err = tx.Commit(); err != nil {
+		log.Println("Accept_plan", err)
+		return APIError("Internal server error", 500)
+	}
+	return APISuccess("OK")
+}
+
+// Get the cumulative and per-term GPA of the user, and the GPA of the courses
+// counted towards the sheet's template and each of its sub-templates
+func (t *DegreeSheetServlet) Get_gpa(r *http.Request) *ApiResult {
+	session_id := r.Form.Get("session")
+	session_valid, session, err := t.session_manager.GetSession(session_id)
+	if err != nil {
+		log.Println("Get_gpa", err)
+		return APIError("Internal server error", 500)
+	}
+	if !session_valid {
+		return APIError("The specified session has expired", 401)
+	}
+
+	sheet_id_s := r.Form.Get("sheet_id")
+	sheet_id, err := strconv.ParseInt(sheet_id_s, 10, 64)
+	if err != nil {
+		return APIError("Bad sheet ID", 400)
+	}
+	sheet, err := GetDegreeSheetById(t.db, sheet_id)
+	if err != nil {
+		log.Println("Get_gpa", err)
+		return APIError("Internal server error", 500)
+	}
+	if sheet.User_id != session.User.Id {
+		return APIError("Specified sheet is not owned by you", 401)
+	}
+
+	template, err := GetDSCategoryById(t.db, sheet.Template_id)
+	if err != nil {
+		return template_load_error("Get_gpa", err)
+	}
+	return APISuccess(SheetGradePointAverages(sheet, template))
+}
+
+// Import taken courses from a CSV file or the text of an unofficial
+// transcript, given as transcript. Returns how each line was matched; lines
+// that could not be matched are listed in Unresolved and courses already on
+// the sheet in Skipped, and neither is imported. With dry_run=1 nothing is
+// saved.
+func (t *DegreeSheetServlet) Import_transcript(r *http.Request) *ApiResult {
+	session_id := r.Form.Get("session")
+	session_valid, session, err := t.session_manager.GetSession(session_id)
+	if err != nil {
+		log.Println("Import_transcript", err)
+		return APIError("Internal server error", 500)
+	}
+	if !session_valid {
+		return APIError("The specified session has expired", 401)
+	}
+
+	sheet_id_s := r.Form.Get("sheet_id")
+	sheet_id, err := strconv.ParseInt(sheet_id_s, 10, 64)
+	if err != nil {
+		return APIError("Bad sheet ID", 400)
+	}
+	sheet, err := GetDegreeSheetById(t.db, sheet_id)
+	if err != nil {
+		log.Println("Import_transcript", err)
+		return APIError("Internal server error", 500)
+	}
+	if sheet.User_id != session.User.Id {
+		return APIError("Specified sheet is not owned by you", 401)
+	}
+
+	transcript := r.Form.Get("transcript")
+	if strings.TrimSpace(transcript) == "" {
+		return APIError("Missing transcript", 400)
+	}
+	result, err := ImportTranscript(t.db, session.User.Id, sheet.Id, transcript,
+		r.Form.Get("dry_run") == "1")
+	if _, ok := err.(*csv.ParseError); ok {
+		return APIError(fmt.Sprintf("Invalid CSV: %s", err), 400)
+	}
+	if err != nil {
+		log.Println("Import_transcript", err)
+		return APIError("Internal server error", 500)
+	}
+	return APISuccess(result)
+}
+
+// Export a sheet and its audit for printing. format is html, pdf or csv (a
+// list of the taken courses). PDF data is base64 encoded.
+func (t *DegreeSheetServlet) Export(r *http.Request) *ApiResult {
+	session_id := r.Form.Get("session")
+	session_valid, session, err := t.session_manager.GetSession(session_id)
+	if err != nil {
+		log.Println("Export", err)
+		return APIError("Internal server error", 500)
+	}
+	if !session_valid {
+		return APIError("The specified session has expired", 401)
+	}
+
+	sheet_id_s := r.Form.Get("sheet_id")
+	sheet_id, err := strconv.ParseInt(sheet_id_s, 10, 64)
+	if err != nil {
+		return APIError("Bad sheet ID", 400)
+	}
+	sheet, err := GetDegreeSheetById(t.db, sheet_id)
+	if err != nil {
+		log.Println("Export", err)
+		return APIError("Internal server error", 500)
+	}
+	if sheet.User_id != session.User.Id {
+		return APIError("Specified sheet is not owned by you", 401)
+	}
+
+	audit, err := AuditDegreeSheet(t.db, sheet)
+	if err != nil {
+		return template_load_error("Export", err)
+	}
+	format := r.Form.Get("format")
+	if format == "" {
+		format = "html"
+	}
+	export, err := ExportDegreeSheet(sheet, audit, format)
+	if err != nil {
+		log.Println("Export", err)
+		return APIError("Internal server error", 500)
+	}
+	if export == nil {
+		return APIError("Unknown export format", 400)
+	}
+	return APISuccess(export)
+}
+
+// Check that the caller may read a sheet: its owner, an advisor of the owner,
+// or anyone with a valid share_token for it. Returns nil if so.
+func (t *DegreeSheetServlet) check_sheet_reader(r *http.Request, sheet *DegreeSheet,
+	method string) *ApiResult {
+	if share_token := r.Form.Get("share_token"); share_token != "" {
+		allowed, err := ShareAllowsSheet(t.db, share_token, sheet.Id)
+		if err != nil {
+			log.Println(method, err)
+			return APIError("Internal server error", 500)
+		}
+		if !allowed {
+			return APIError("The share link is invalid, expired or revoked", 401)
+		}
+		return nil
+	}
+
+	session_id := r.Form.Get("session")
+	session_valid, session, err := t.session_manager.GetSession(session_id)
+	if err != nil {
+		log.Println(method, err)
+		return APIError("Internal server error", 500)
+	}
+	if !session_valid {
+		return APIError("The specified session has expired", 401)
+	}
+	if sheet.User_id == session.User.Id {
+		return nil
+	}
+	if session.User.Role == ROLE_ADVISOR {
+		advises, err := IsAdvisorOf(t.db, session.User.Id, sheet.User_id)
+		if err != nil {
+			log.Println(method, err)
+			return APIError("Internal server error", 500)
+		}
+		if advises {
+			return nil
+		}
+	}
+	return APIError("Specified sheet is not owned by you", 401)
+}
+
+// Get the sheet named by sheet_id, checking that the session owns it
+func (t *DegreeSheetServlet) owned_sheet(r *http.Request, method string) (*DegreeSheet, *ApiResult) {
+	session_id := r.Form.Get("session")
+	session_valid, session, err := t.session_manager.GetSession(session_id)
+	if err != nil {
+		log.Println(method, err)
+		return nil, APIError("Internal server error", 500)
+	}
+	if !session_valid {
+		return nil, APIError("The specified session has expired", 401)
+	}
+
+	sheet_id_s := r.Form.Get("sheet_id")
+	sheet_id, err := strconv.ParseInt(sheet_id_s, 10, 64)
+	if err != nil {
+		return nil, APIError("Bad sheet ID", 400)
+	}
+	sheet, err := GetDegreeSheetById(t.db, sheet_id)
+	if err != nil {
+		log.Println(method, err)
+		return nil, APIError("Internal server error", 500)
+	}
+	if sheet.User_id != session.User.Id {
+		return nil, APIError("Specified sheet is not owned by you", 401)
+	}
+	return sheet, nil
+}
+
+// Create a read-only share link for a sheet. The token can be passed as
+// share_token instead of a session to Get_sheet, Get_taken_classes and
+// Audit. Optionally expires after expires_days days.
+func (t *DegreeSheetServlet) Create_share(r *http.Request) *ApiResult {
+	sheet, result := t.owned_sheet(r, "Create_share")
+	if result != nil {
+		return result
+	}
+
+	expires := sql.NullTime{}
+	if r.Form.Get("expires_days") != "" {
+		days, err := strconv.ParseInt(r.Form.Get("expires_days"), 10, 64)
+		if err != nil || days < 1 {
+			return APIError("Bad number of days", 400)
+		}
+		expires = sql.NullTime{Time: time.Now().AddDate(0, 0, int(days)), Valid: true}
+	}
+
+	share, err := CreateSheetShare(t.db, sheet.Id, expires)
+	if err != nil {
+		log.Println("Create_share", err)
+		return APIError("Internal server error", 500)
+	}
+	return APISuccess(share)
+}
+
+// List the share links of a sheet, including revoked and expired ones
+func (t *DegreeSheetServlet) List_shares(r *http.Request) *ApiResult {
+	sheet, result := t.owned_sheet(r, "List_shares")
+	if result != nil {
+		return result
+	}
+	shares, err := GetSharesForSheet(t.db, sheet.Id)
+	if err != nil {
+		log.Println("List_shares", err)
+		return APIError("Internal server error", 500)
+	}
+	return APISuccess(shares)
+}
+
+// Revoke a share link of a sheet
+func (t *DegreeSheetServlet) Revoke_share(r *http.Request) *ApiResult {
+	sheet, result := t.owned_sheet(r, "Revoke_share")
+	if result != nil {
+		return result
+	}
+	revoked, err := RevokeSheetShare(t.db, sheet.Id, r.Form.Get("token"))
+	if err != nil {
+		log.Println("Revoke_share", err)
+		return APIError("Internal server error", 500)
+	}
+	if !revoked {
+		return APIError("No such share link for this sheet", 400)
+	}
+	return APISuccess("OK")
 }
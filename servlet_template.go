@@ -0,0 +1,568 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	_ "github.com/go-sql-driver/mysql"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Editing of degree sheet templates (ds_category and ds_category_rule).
+// Only users listed as an Editor in the Templates section of the server config
+// may use these methods.
+type TemplateServlet struct {
+	db              *sql.DB
+	server_config   *Config
+	session_manager *SessionManager
+}
+
+func NewTemplateServlet(server_config *Config, session_manager *SessionManager) *TemplateServlet {
+	t := new(TemplateServlet)
+	t.session_manager = session_manager
+	t.server_config = server_config
+
+	db, err := sql.Open("mysql", server_config.GetSqlURI())
+	if err != nil {
+		log.Fatal("NewTemplateServlet", "Failed to open database:", err)
+	}
+	t.db = db
+	return t
+}
+
+// Check that a request comes from a user allowed to edit templates. Returns
+// the error to send back if it does not, or nil if it does.
+func (t *TemplateServlet) check_editor(r *http.Request, method string) *ApiResult {
+	session_id := r.Form.Get("session")
+	session_valid, session, err := t.session_manager.GetSession(session_id)
+	if err != nil {
+		log.Println(method, err)
+		return APIError("Internal server error", 500)
+	}
+	if !session_valid {
+		return APIError("The specified session has expired", 401)
+	}
+	for _, editor := range t.server_config.Templates.Editor {
+		if editor == session.User.Username {
+			return nil
+		}
+	}
+	return APIError("You are not allowed to edit degree templates", 401)
+}
+
+// Create a new, empty template. Returns the ID of the template.
+func (t *TemplateServlet) Create(r *http.Request) *ApiResult {
+	if result := t.check_editor(r, "Create"); result != nil {
+		return result
+	}
+	name := r.Form.Get("name")
+	if name == "" {
+		return APIError("Missing value for one or more fields", 400)
+	}
+
+	if result := t.check_name(name, 0, "Create"); result != nil {
+		return result
+	}
+
+	result, err := t.db.Exec("INSERT INTO ds_category (name) VALUES (?)", name)
+	if err != nil {
+		log.Println("Create", err)
+		return APIError("Internal server error", 500)
+	}
+	template_id, err := result.LastInsertId()
+	if err != nil {
+		log.Println("Create", err)
+		return APIError("Internal server error", 500)
+	}
+	return APISuccess(template_id)
+}
+
+func (t *TemplateServlet) Rename(r *http.Request) *ApiResult {
+	if result := t.check_editor(r, "Rename"); result != nil {
+		return result
+	}
+	template_id, err := strconv.ParseInt(r.Form.Get("template_id"), 10, 64)
+	if err != nil {
+		return APIError("Bad template ID", 400)
+	}
+	name := r.Form.Get("name")
+	if name == "" {
+		return APIError("Missing value for one or more fields", 400)
+	}
+	if result := t.check_template(template_id, "Rename"); result != nil {
+		return result
+	}
+	if result := t.check_name(name, template_id, "Rename"); result != nil {
+		return result
+	}
+
+	_, err = t.db.Exec("UPDATE ds_category SET name = ? WHERE id = ?", name, template_id)
+	if err != nil {
+		log.Println("Rename", err)
+		return APIError("Internal server error", 500)
+	}
+	return APISuccess("OK")
+}
+
+// Delete a template and its rules. Templates that degree sheets are using or
+// that other templates inherit can't be deleted.
+func (t *TemplateServlet) Delete(r *http.Request) *ApiResult {
+	if result := t.check_editor(r, "Delete"); result != nil {
+		return result
+	}
+	template_id, err := strconv.ParseInt(r.Form.Get("template_id"), 10, 64)
+	if err != nil {
+		return APIError("Bad template ID", 400)
+	}
+
+	var sheets, inheritors int64
+	err = t.db.QueryRow("SELECT COUNT(*) FROM degree_sheet WHERE template_id = ?",
+		template_id).Scan(&sheets)
+	if err != nil {
+		log.Println("Delete", err)
+		return APIError("Internal server error", 500)
+	}
+	err = t.db.QueryRow("SELECT COUNT(*) FROM ds_category_rule WHERE inherited_id = ?",
+		template_id).Scan(&inheritors)
+	if err != nil {
+		log.Println("Delete", err)
+		return APIError("Internal server error", 500)
+	}
+	if sheets > 0 || inheritors > 0 {
+		return APIError(fmt.Sprintf("Template #%d is used by %d sheets and %d templates",
+			template_id, sheets, inheritors), 400)
+	}
+
+	tx, err := t.db.Begin()
+	if err != nil {
+		log.Println("Delete", err)
+		return APIError("Internal server error", 500)
+	}
+	_, err = tx.Exec("DELETE FROM ds_category_rule WHERE category = ?", template_id)
+	if err != nil {
+		tx.Rollback()
+		log.Println("Delete", err)
+		return APIError("Internal server error", 500)
+	}
+	_, err = tx.Exec(
+		"DELETE FROM ds_category_overlap WHERE template_a = ? OR template_b = ?",
+		template_id, template_id)
+	if err != nil {
+		tx.Rollback()
+		log.Println("Delete", err)
+		return APIError("Internal server error", 500)
+	}
+	res, err := tx.Exec("DELETE FROM ds_category WHERE id = ?", template_id)
+	if err != nil {
+		tx.Rollback()
+		log.Println("Delete", err)
+		return APIError("Internal server error", 500)
+	}
+	deleted, err := res.RowsAffected()
+	if err != nil {
+		tx.Rollback()
+		log.Println("Delete", err)
+		return APIError("Internal server error", 500)
+	}
+	if deleted == 0 {
+		tx.Rollback()
+		return APIError("No such template", 400)
+	}
+	if err = tx.Commit(); err != nil {
+		log.Println("Delete", err)
+		return APIError("Internal server error", 500)
+	}
+	return APISuccess("OK")
+}
+
+// Adds a rule to a template. Returns the ID of the new rule.
+// Params:
+//   - Valid session
+//   - Template ID
+//   - Ruletype
+//   - Class ID, category ID or inherited template ID, depending on the ruletype
+//   - Optionally whether pass/fail courses are allowed (0 or 1)
+//   - Optionally min_count, min_credits and min_grade
+func (t *TemplateServlet) Add_rule(r *http.Request) *ApiResult {
+	if result := t.check_editor(r, "Add_rule"); result != nil {
+		return result
+	}
+
+	rule, err := parse_rule_form(r)
+	if err != nil {
+		return APIError(err.Error(), 400)
+	}
+	if result := t.check_rule(rule); result != nil {
+		return result
+	}
+
+	rule.Id, err = InsertDSCategoryRule(t.db, rule)
+	if err != nil {
+		log.Println("Add_rule", err)
+		return APIError("Internal server error", 500)
+	}
+
+	// Make sure the template still loads, e.g. that the rule didn't nest the
+	// template's inheritance too deeply
+	_, err = GetDSCategoryById(t.db, rule.Category)
+	if err != nil {
+		if _, delete_err := t.db.Exec("DELETE FROM ds_category_rule WHERE id = ?",
+			rule.Id); delete_err != nil {
+			log.Println("Add_rule", delete_err)
+		}
+		return template_load_error("Add_rule", err)
+	}
+	return APISuccess(rule.Id)
+}
+
+func (t *TemplateServlet) Remove_rule(r *http.Request) *ApiResult {
+	if result := t.check_editor(r, "Remove_rule"); result != nil {
+		return result
+	}
+	rule_id, err := strconv.ParseInt(r.Form.Get("rule_id"), 10, 64)
+	if err != nil {
+		return APIError("Bad rule ID", 400)
+	}
+
+	res, err := t.db.Exec("DELETE FROM ds_category_rule WHERE id = ?", rule_id)
+	if err != nil {
+		log.Println("Remove_rule", err)
+		return APIError("Internal server error", 500)
+	}
+	deleted, err := res.RowsAffected()
+	if err != nil {
+		log.Println("Remove_rule", err)
+		return APIError("Internal server error", 500)
+	}
+	if deleted == 0 {
+		return APIError("No such rule", 400)
+	}
+	return APISuccess("OK")
+}
+
+// Set the program, catalog year and effective dates (YYYY-MM-DD) of a
+// template. Fields left empty are cleared.
+func (t *TemplateServlet) Set_catalog_info(r *http.Request) *ApiResult {
+	if result := t.check_editor(r, "Set_catalog_info"); result != nil {
+		return result
+	}
+	template_id, err := strconv.ParseInt(r.Form.Get("template_id"), 10, 64)
+	if err != nil {
+		return APIError("Bad template ID", 400)
+	}
+
+	program := sql.NullString{String: r.Form.Get("program"), Valid: r.Form.Get("program") != ""}
+	catalog_year, err := form_null_int(r, "catalog_year")
+	if err != nil {
+		return APIError(err.Error(), 400)
+	}
+	effective_from, err := form_null_date(r, "effective_from")
+	if err != nil {
+		return APIError(err.Error(), 400)
+	}
+	effective_to, err := form_null_date(r, "effective_to")
+	if err != nil {
+		return APIError(err.Error(), 400)
+	}
+	if result := t.check_template(template_id, "Set_catalog_info"); result != nil {
+		return result
+	}
+
+	_, err = t.db.Exec(`UPDATE ds_category SET program = ?, catalog_year = ?,
+		effective_from = ?, effective_to = ? WHERE id = ?`,
+		program, catalog_year, effective_from, effective_to, template_id)
+	if err != nil {
+		log.Println("Set_catalog_info", err)
+		return APIError("Internal server error", 500)
+	}
+	return APISuccess("OK")
+}
+
+// Copy a template and everything it inherits into another catalog year,
+// optionally naming the copy name. Returns the ID of the copy.
+func (t *TemplateServlet) Clone(r *http.Request) *ApiResult {
+	if result := t.check_editor(r, "Clone"); result != nil {
+		return result
+	}
+	template_id, err := strconv.ParseInt(r.Form.Get("template_id"), 10, 64)
+	if err != nil {
+		return APIError("Bad template ID", 400)
+	}
+	catalog_year, err := strconv.ParseInt(r.Form.Get("catalog_year"), 10, 64)
+	if err != nil {
+		return APIError("Bad catalog year", 400)
+	}
+
+	clone_id, err := CloneTemplate(t.db, template_id, catalog_year, r.Form.Get("name"))
+	if name_err, ok := err.(*TemplateNameError); ok {
+		return APIError(name_err.Error(), 400)
+	}
+	if err == sql.ErrNoRows {
+		return APIError("No such template", 400)
+	}
+	if err != nil {
+		return template_load_error("Clone", err)
+	}
+	return APISuccess(clone_id)
+}
+
+// Limit how many courses may count towards both of two templates. A
+// max_shared of 0 forbids sharing, leaving it empty removes the limit.
+func (t *TemplateServlet) Set_overlap_policy(r *http.Request) *ApiResult {
+	if result := t.check_editor(r, "Set_overlap_policy"); result != nil {
+		return result
+	}
+	template_a, err := strconv.ParseInt(r.Form.Get("template_a"), 10, 64)
+	if err != nil {
+		return APIError("Bad template ID", 400)
+	}
+	template_b, err := strconv.ParseInt(r.Form.Get("template_b"), 10, 64)
+	if err != nil {
+		return APIError("Bad template ID", 400)
+	}
+	if template_a == template_b {
+		return APIError("A template cannot overlap itself", 400)
+	}
+	max_shared := int64(-1)
+	if r.Form.Get("max_shared") != "" {
+		max_shared, err = strconv.ParseInt(r.Form.Get("max_shared"), 10, 64)
+		if err != nil || max_shared < 0 {
+			return APIError("Bad maximum number of shared courses", 400)
+		}
+	}
+
+	if err = SetOverlapPolicy(t.db, template_a, template_b, max_shared); err != nil {
+		log.Println("Set_overlap_policy", err)
+		return APIError("Internal server error", 500)
+	}
+	return APISuccess("OK")
+}
+
+// Load a template file (see template_file.go), passed as JSON in the document
+// field. Returns the IDs of the imported templates by name.
+func (t *TemplateServlet) Import(r *http.Request) *ApiResult {
+	if result := t.check_editor(r, "Import"); result != nil {
+		return result
+	}
+
+	file := new(TemplateFile)
+	err := json.Unmarshal([]byte(r.Form.Get("document")), file)
+	if err != nil {
+		return APIError(fmt.Sprintf("Invalid template document: %s", err), 400)
+	}
+
+	template_ids, err := ImportTemplateFile(t.db, file)
+	if file_err, ok := err.(*TemplateFileError); ok {
+		return APIErrorWithData("Invalid template document", 400, file_err.Problems)
+	}
+	if err != nil {
+		log.Println("Import", err)
+		return APIError("Internal server error", 500)
+	}
+	return APISuccess(template_ids)
+}
+
+// Write out a template and everything it inherits as a template file. The
+// class categories it uses are included if include_categories is 1. Not
+// cached, as templates change under Add_rule and Remove_rule.
+func (t *TemplateServlet) Export(r *http.Request) *ApiResult {
+	template_id, err := strconv.ParseInt(r.Form.Get("template_id"), 10, 64)
+	if err != nil {
+		return APIError("Bad template ID", 400)
+	}
+	include_categories := r.Form.Get("include_categories") == "1"
+
+	file, err := ExportTemplate(t.db, template_id, include_categories)
+	if err == sql.ErrNoRows {
+		return APIError("No such template", 400)
+	}
+	if err != nil {
+		return template_load_error("Export", err)
+	}
+	return APISuccess(file)
+}
+
+// Check that a template exists. UPDATE reports no affected rows when nothing
+// changes, so it can't be used to tell.
+func (t *TemplateServlet) check_template(template_id int64, method string) *ApiResult {
+	var count int64
+	err := t.db.QueryRow("SELECT COUNT(*) FROM ds_category WHERE id = ?",
+		template_id).Scan(&count)
+	if err != nil {
+		log.Println(method, err)
+		return APIError("Internal server error", 500)
+	}
+	if count == 0 {
+		return APIError("No such template", 400)
+	}
+	return nil
+}
+
+// Check that no other template than template_id is called name
+func (t *TemplateServlet) check_name(name string, template_id int64, method string) *ApiResult {
+	err := check_template_name(t.db, name, template_id)
+	if name_err, ok := err.(*TemplateNameError); ok {
+		return APIError(name_err.Error(), 400)
+	}
+	if err != nil {
+		log.Println(method, err)
+		return APIError("Internal server error", 500)
+	}
+	return nil
+}
+
+// Check a new rule the way the template loader would, and that the things it
+// refers to exist. Returns the error to send back, or nil if the rule is
+// valid.
+func (t *TemplateServlet) check_rule(rule *DSCategoryRule) *ApiResult {
+	if !ruletype_known(rule.Ruletype) {
+		return APIError(fmt.Sprintf("Unknown ruletype %d", rule.Ruletype), 400)
+	}
+	if err := check_ds_category_rule(rule); err != nil {
+		return APIError(err.Error(), 400)
+	}
+
+	var id int64
+	err := t.db.QueryRow("SELECT id FROM ds_category WHERE id = ?", rule.Category).Scan(&id)
+	if err == sql.ErrNoRows {
+		return APIError(fmt.Sprintf("No template #%d", rule.Category), 400)
+	}
+	if err != nil {
+		log.Println("check_rule", err)
+		return APIError("Internal server error", 500)
+	}
+
+	if rule.Class_id.Valid {
+		err := t.db.QueryRow("SELECT id FROM class WHERE id = ?", rule.Class_id.Int64).Scan(&id)
+		if err == sql.ErrNoRows {
+			return APIError(fmt.Sprintf("No class #%d", rule.Class_id.Int64), 400)
+		}
+		if err != nil {
+			log.Println("check_rule", err)
+			return APIError("Internal server error", 500)
+		}
+	}
+
+	if rule.Category_id.Valid {
+		err := t.db.QueryRow("SELECT id FROM class_category WHERE id = ?",
+			rule.Category_id.Int64).Scan(&id)
+		if err == sql.ErrNoRows {
+			return APIError(fmt.Sprintf("No class category #%d", rule.Category_id.Int64), 400)
+		}
+		if err != nil {
+			log.Println("check_rule", err)
+			return APIError("Internal server error", 500)
+		}
+	}
+
+	if rule.Inherit_id.Valid {
+		inherited, err := GetDSCategoryById(t.db, rule.Inherit_id.Int64)
+		if err == sql.ErrNoRows {
+			return APIError(fmt.Sprintf("No template #%d", rule.Inherit_id.Int64), 400)
+		}
+		if err != nil {
+			return template_load_error("check_rule", err)
+		}
+
+		// The new rule would close a loop if the inherited template already
+		// inherits the template the rule is being added to
+		path := inheritance_path(inherited, rule.Category)
+		if path != nil {
+			template_ids := []int64{rule.Category}
+			rule_ids := make([]int64, 0)
+			for _, path_rule := range path {
+				template_ids = append(template_ids, path_rule.Category)
+				rule_ids = append(rule_ids, path_rule.Id)
+			}
+			return APIErrorWithData("Template inherits from itself", 400,
+				&TemplateInheritanceError{
+					Problem:      "Template inherits from itself",
+					Template_ids: template_ids,
+					Rule_ids:     rule_ids,
+				})
+		}
+	}
+	return nil
+}
+
+// Read the fields of a rule from a request
+func parse_rule_form(r *http.Request) (*DSCategoryRule, error) {
+	rule := new(DSCategoryRule)
+	var err error
+
+	rule.Category, err = strconv.ParseInt(r.Form.Get("template_id"), 10, 64)
+	if err != nil {
+		return nil, errors.New("Bad template ID")
+	}
+	rule.Ruletype, err = strconv.ParseInt(r.Form.Get("ruletype"), 10, 64)
+	if err != nil {
+		return nil, errors.New("Bad ruletype")
+	}
+	if rule.Class_id, err = form_null_int(r, "class_id"); err != nil {
+		return nil, err
+	}
+	if rule.Category_id, err = form_null_int(r, "category_id"); err != nil {
+		return nil, err
+	}
+	if rule.Inherit_id, err = form_null_int(r, "inherited_id"); err != nil {
+		return nil, err
+	}
+	if rule.Min_count, err = form_null_int(r, "min_count"); err != nil {
+		return nil, err
+	}
+
+	rule.Passfail_allowed = r.Form.Get("passfail_allowed") != "0"
+
+	if min_credits := r.Form.Get("min_credits"); min_credits != "" {
+		rule.Min_credits.Float64, err = strconv.ParseFloat(min_credits, 64)
+		if err != nil {
+			return nil, errors.New("Bad min_credits")
+		}
+		rule.Min_credits.Valid = true
+	}
+	if min_grade := r.Form.Get("min_grade"); min_grade != "" {
+		rule.Min_grade = sql.NullString{String: min_grade, Valid: true}
+	}
+	return rule, nil
+}
+
+// Read an optional integer form field
+func form_null_int(r *http.Request, field string) (sql.NullInt64, error) {
+	value := r.Form.Get(field)
+	if value == "" {
+		return sql.NullInt64{}, nil
+	}
+	i, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return sql.NullInt64{}, errors.New(fmt.Sprintf("Bad %s", field))
+	}
+	return sql.NullInt64{Int64: i, Valid: true}, nil
+}
+
+// Read an optional date form field in YYYY-MM-DD form
+func form_null_date(r *http.Request, field string) (sql.NullTime, error) {
+	value := r.Form.Get(field)
+	if value == "" {
+		return sql.NullTime{}, nil
+	}
+	date, err := time.Parse(template_date_format, value)
+	if err != nil {
+		return sql.NullTime{}, errors.New(fmt.Sprintf("Bad %s", field))
+	}
+	return sql.NullTime{Time: date, Valid: true}, nil
+}
+
+// The response for a template that failed to load. Broken inheritance is the
+// template author's problem and is reported with the templates and rules
+// involved, anything else is ours.
+func template_load_error(method string, err error) *ApiResult {
+	if inheritance_err, ok := err.(*TemplateInheritanceError); ok {
+		return APIErrorWithData(inheritance_err.Problem, 400, inheritance_err)
+	}
+	log.Println(method, err)
+	return APIError("Internal server error", 500)
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"code.google.com/p/go-uuid/uuid"
+	"database/sql"
+	"time"
+)
+
+/*
+ * Read-only share links for degree sheets. The owner of a sheet can create
+ * tokens, optionally expiring, that let anyone holding them read the sheet
+ * without a session until the token is revoked.
+ */
+
+type SheetShare struct {
+	Token    string
+	Sheet_id int64
+	Created  time.Time
+	Expires  sql.NullTime
+	Revoked  bool
+}
+
+func CreateSheetShare(db *sql.DB, sheet_id int64, expires sql.NullTime) (*SheetShare, error) {
+	share := &SheetShare{
+		Token:    uuid.New(),
+		Sheet_id: sheet_id,
+		Created:  time.Now(),
+		Expires:  expires,
+	}
+	_, err := db.Exec(`INSERT INTO sheet_share (token, sheet_id, created, expires)
+		VALUES (?, ?, ?, ?)`, share.Token, share.Sheet_id, share.Created, share.Expires)
+	if err != nil {
+		return nil, err
+	}
+	return share, nil
+}
+
+func GetSharesForSheet(db *sql.DB, sheet_id int64) ([]*SheetShare, error) {
+	rows, err := db.Query(`SELECT token, sheet_id, created, expires, revoked
+		FROM sheet_share WHERE sheet_id = ? ORDER BY created`, sheet_id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	shares := make([]*SheetShare, 0)
+	for rows.Next() {
+		share := new(SheetShare)
+		if err := rows.Scan(
+			&share.Token,
+			&share.Sheet_id,
+			&share.Created,
+			&share.Expires,
+			&share.Revoked); err != nil {
+			return nil, err
+		}
+		shares = append(shares, share)
+	}
+	return shares, rows.Err()
+}
+
+// Revoke a share token of a sheet. Returns false if the sheet has no such
+// token.
+func RevokeSheetShare(db *sql.DB, sheet_id int64, token string) (bool, error) {
+	var count int64
+	err := db.QueryRow("SELECT COUNT(*) FROM sheet_share WHERE token = ? AND sheet_id = ?",
+		token, sheet_id).Scan(&count)
+	if err != nil || count == 0 {
+		return false, err
+	}
+	_, err = db.Exec("UPDATE sheet_share SET revoked = 1 WHERE token = ?", token)
+	return err == nil, err
+}
+
+// Whether a token currently grants read access to a sheet
+func ShareAllowsSheet(db *sql.DB, token string, sheet_id int64) (bool, error) {
+	share := new(SheetShare)
+	err := db.QueryRow(`SELECT sheet_id, expires, revoked FROM sheet_share
+		WHERE token = ?`, token).Scan(&share.Sheet_id, &share.Expires, &share.Revoked)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if share.Revoked || share.Sheet_id != sheet_id {
+		return false, nil
+	}
+	return !share.Expires.Valid || time.Now().Before(share.Expires.Time), nil
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"database/sql/driver"
+	"testing"
+	"time"
+)
+
+func TestShareAllowsSheet(t *testing.T) {
+	tomorrow, yesterday := time.Now().Add(24*time.Hour), time.Now().Add(-24*time.Hour)
+	// Tokens with their sheet, expiry and revocation
+	shares := map[string][]driver.Value{
+		"open":    {int64(1), nil, int64(0)},
+		"current": {int64(1), tomorrow, int64(0)},
+		"expired": {int64(1), yesterday, int64(0)},
+		"revoked": {int64(1), nil, int64(1)},
+	}
+	db, _ := open_test_db(&testResult{pattern: "SELECT sheet_id, expires, revoked", answer: func(args []driver.Value) [][]driver.Value {
+		if share, exists := shares[args[0].(string)]; exists {
+			return [][]driver.Value{share}
+		}
+		return nil
+	}})
+
+	cases := []struct {
+		token    string
+		sheet_id int64
+		allowed  bool
+	}{
+		{"open", 1, true},
+		{"current", 1, true},
+		{"expired", 1, false},
+		{"revoked", 1, false},
+		{"open", 2, false},
+		{"unknown", 1, false},
+	}
+	for _, c := range cases {
+		allowed, err := ShareAllowsSheet(db, c.token, c.sheet_id)
+		if err != nil || allowed != c.allowed {
+			t.Errorf("%s for sheet %d: got %v, %v, want %v", c.token, c.sheet_id,
+				allowed, err, c.allowed)
+		}
+	}
+}
+
+func TestRevokeSheetShare(t *testing.T) {
+	db, fake := open_test_db(&testResult{pattern: "SELECT COUNT(*) FROM sheet_share", answer: func(args []driver.Value) [][]driver.Value {
+		if args[0] == "token" && args[1] == int64(1) {
+			return [][]driver.Value{{int64(1)}}
+		}
+		return [][]driver.Value{{int64(0)}}
+	}})
+
+	// Another sheet's owner can't revoke the token
+	if revoked, err := RevokeSheetShare(db, 2, "token"); err != nil || revoked {
+		t.Errorf("other sheet: got %v, %v", revoked, err)
+	}
+	if len(fake.ran("UPDATE sheet_share")) != 0 {
+		t.Errorf("revoked a token of another sheet")
+	}
+
+	if revoked, err := RevokeSheetShare(db, 1, "token"); err != nil || !revoked {
+		t.Errorf("own sheet: got %v, %v", revoked, err)
+	}
+	updates := fake.ran("UPDATE sheet_share SET revoked = 1")
+	if len(updates) != 1 || updates[0].args[0] != "token" {
+		t.Errorf("got updates %v, want one for the token", updates)
+	}
+}
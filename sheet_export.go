@@ -0,0 +1,384 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/csv"
+	"fmt"
+	"html/template"
+	"strconv"
+	"strings"
+)
+
+/*
+ * Printable reports of a degree sheet: an HTML page, a PDF with the same
+ * content as plain text, and a CSV of the taken courses. Everything is
+ * generated here without external tools.
+ */
+
+type SheetExport struct {
+	Filename     string
+	Content_type string
+	// Base64 encoded for binary formats
+	Encoding string
+	Data     string
+}
+
+// Render a sheet and its audit in a format, one of html, pdf and csv
+func ExportDegreeSheet(sheet *DegreeSheet, audit *AuditResult, format string) (*SheetExport, error) {
+	export := &SheetExport{Filename: export_filename(sheet, format)}
+	if format == "html" {
+		var buffer bytes.Buffer
+		if err := sheet_report_template.Execute(&buffer, sheet_report_data(sheet, audit)); err != nil {
+			return nil, err
+		}
+		export.Content_type = "text/html; charset=utf-8"
+		export.Data = buffer.String()
+	} else if format == "csv" {
+		data, err := sheet_courses_csv(sheet, audit)
+		if err != nil {
+			return nil, err
+		}
+		export.Content_type = "text/csv"
+		export.Data = data
+	} else if format == "pdf" {
+		export.Content_type = "application/pdf"
+		export.Encoding = "base64"
+		export.Data = base64.StdEncoding.EncodeToString(
+			text_pdf(sheet_report_lines(sheet, audit)))
+	} else {
+		return nil, nil
+	}
+	return export, nil
+}
+
+func export_filename(sheet *DegreeSheet, format string) string {
+	name := strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' {
+			return r
+		}
+		return '_'
+	}, sheet.Name)
+	if name == "" {
+		name = fmt.Sprintf("sheet_%d", sheet.Id)
+	}
+	return name + "." + format
+}
+
+// A requirement flattened for the report, with its depth in the tree
+type reportRequirement struct {
+	Depth     int
+	Indent    string
+	Padding   float64
+	Name      string
+	Satisfied bool
+	// Leaves list what they are missing, groups leave it to their children
+	Leaf     bool
+	Progress string
+	Courses  []string
+	Missing  []string
+}
+
+type reportData struct {
+	Sheet        *DegreeSheet
+	Audit        *AuditResult
+	Requirements []*reportRequirement
+	Courses      [][]string
+}
+
+func sheet_report_data(sheet *DegreeSheet, audit *AuditResult) *reportData {
+	data := &reportData{
+		Sheet:        sheet,
+		Audit:        audit,
+		Requirements: make([]*reportRequirement, 0),
+		Courses:      make([][]string, 0),
+	}
+	var walk func(requirements []*AuditRequirement, depth int)
+	walk = func(requirements []*AuditRequirement, depth int) {
+		for _, requirement := range requirements {
+			line := &reportRequirement{
+				Depth:     depth,
+				Indent:    strings.Repeat("    ", depth),
+				Padding:   0.5 + 1.5*float64(depth),
+				Name:      requirement.Name,
+				Satisfied: requirement.Satisfied,
+				Leaf:      len(requirement.Children) == 0,
+				Progress:  fmt.Sprintf("%g/%g", requirement.Completed, requirement.Required),
+				Courses:   make([]string, 0),
+				Missing:   requirement.Missing,
+			}
+			for _, course := range requirement.Courses {
+				line.Courses = append(line.Courses, course_summary(course))
+			}
+			data.Requirements = append(data.Requirements, line)
+			walk(requirement.Children, depth+1)
+		}
+	}
+	walk(audit.Requirements, 0)
+
+	for _, course := range sheet.Taken_courses {
+		data.Courses = append(data.Courses, course_report_row(course))
+	}
+	return data
+}
+
+// e.g. "COMP 15 (A-, Fall 2015)"
+func course_summary(course *TakenCourse) string {
+	name := fmt.Sprintf("Class #%d", course.Class_id)
+	if course.Class != nil {
+		name = class_name(course.Class)
+	}
+	grade := course.Grade
+	if grade == "" {
+		grade = "in progress"
+	}
+	return fmt.Sprintf("%s (%s, %s)", name, grade, term_name(course.Year, course.Semester))
+}
+
+func term_name(year int64, semester int64) string {
+	if semester == 1 {
+		return fmt.Sprintf("Spring %d", year)
+	} else if semester == 2 {
+		return fmt.Sprintf("Fall %d", year)
+	}
+	return fmt.Sprintf("%d-%d", year, semester)
+}
+
+// Class, name, term, grade, pass/fail and credits of a taken course
+func course_report_row(course *TakenCourse) []string {
+	class, name, credits := fmt.Sprintf("#%d", course.Class_id), "", ""
+	if course.Class != nil {
+		class = class_name(course.Class)
+		name = course.Class.Name
+		credits = strconv.FormatFloat(class_credits(course.Class), 'g', -1, 64)
+	}
+	passfail := ""
+	if course.Passfail {
+		passfail = "P/F"
+	}
+	return []string{class, name, term_name(course.Year, course.Semester),
+		course.Grade, passfail, credits}
+}
+
+var sheet_report_template = template.Must(template.New("sheet").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{.Sheet.Name}}</title>
+<style>
+body { font-family: sans-serif; font-size: 11pt; }
+table { border-collapse: collapse; }
+td, th { border: 1px solid #999; padding: 2px 6px; text-align: left; }
+.met { color: #060; }
+.unmet { color: #a00; }
+</style>
+</head>
+<body>
+<h1>{{.Sheet.Name}}</h1>
+<p>{{.Audit.Template_name}} &mdash;
+{{if .Audit.Satisfied}}all requirements met{{else}}requirements outstanding{{end}}</p>
+{{with .Sheet.Credits}}<p>Credits earned: {{.Earned}}, in progress: {{.In_progress}}, planned: {{.Planned}}</p>{{end}}
+<h2>Requirements</h2>
+<table>
+<tr><th>Requirement</th><th>Progress</th><th>Courses</th><th>Remaining</th></tr>
+{{range .Requirements}}<tr class="{{if .Satisfied}}met{{else}}unmet{{end}}">
+<td style="padding-left: {{.Padding}}em">{{if .Satisfied}}&#10003;{{else}}&#10007;{{end}} {{.Name}}</td>
+<td>{{.Progress}}</td>
+<td>{{range $i, $c := .Courses}}{{if $i}}, {{end}}{{$c}}{{end}}</td>
+<td>{{range $i, $m := .Missing}}{{if $i}}, {{end}}{{$m}}{{end}}</td>
+</tr>
+{{end}}</table>
+<h2>Taken courses</h2>
+<table>
+<tr><th>Class</th><th>Name</th><th>Term</th><th>Grade</th><th>Pass/fail</th><th>Credits</th></tr>
+{{range .Courses}}<tr>{{range .}}<td>{{.}}</td>{{end}}</tr>
+{{end}}</table>
+</body>
+</html>
+`))
+
+// The report as plain text lines, for the PDF
+func sheet_report_lines(sheet *DegreeSheet, audit *AuditResult) []string {
+	data := sheet_report_data(sheet, audit)
+	lines := []string{sheet.Name, audit.Template_name, ""}
+	if sheet.Credits != nil {
+		lines = append(lines, fmt.Sprintf("Credits earned: %g, in progress: %g, planned: %g",
+			sheet.Credits.Earned, sheet.Credits.In_progress, sheet.Credits.Planned), "")
+	}
+
+	lines = append(lines, "Requirements", "")
+	for _, requirement := range data.Requirements {
+		mark := "[ ]"
+		if requirement.Satisfied {
+			mark = "[x]"
+		}
+		lines = append(lines, fmt.Sprintf("%s%s %s  %s", requirement.Indent, mark,
+			requirement.Name, requirement.Progress))
+		for _, course := range requirement.Courses {
+			lines = append(lines, requirement.Indent+"      "+course)
+		}
+		if !requirement.Satisfied && requirement.Leaf {
+			for _, missing := range requirement.Missing {
+				lines = append(lines, requirement.Indent+"      needs "+missing)
+			}
+		}
+	}
+
+	lines = append(lines, "", "Taken courses", "")
+	for _, row := range data.Courses {
+		lines = append(lines, strings.Join(row, "  "))
+	}
+	return lines
+}
+
+func sheet_courses_csv(sheet *DegreeSheet, audit *AuditResult) (string, error) {
+	// Name the requirement each course was counted towards
+	counted := make(map[int64]string)
+	var walk func(requirements []*AuditRequirement)
+	walk = func(requirements []*AuditRequirement) {
+		for _, requirement := range requirements {
+			for _, course := range requirement.Courses {
+				counted[course.Id] = requirement.Name
+			}
+			walk(requirement.Children)
+		}
+	}
+	walk(audit.Requirements)
+
+	var buffer bytes.Buffer
+	writer := csv.NewWriter(&buffer)
+	writer.Write([]string{"Class", "Name", "Term", "Grade", "Pass/fail", "Credits",
+		"Counted towards"})
+	for _, course := range sheet.Taken_courses {
+		writer.Write(append(course_report_row(course), counted[course.Id]))
+	}
+	writer.Flush()
+	return buffer.String(), writer.Error()
+}
+
+// Write lines of text as a minimal PDF, in Courier on US letter pages. Lines
+// too long for the page are wrapped.
+func text_pdf(lines []string) []byte {
+	const lines_per_page = 60
+	wrapped := make([]string, 0, len(lines))
+	for _, line := range lines {
+		wrapped = append(wrapped, wrap_line(line, pdf_line_width)...)
+	}
+	lines = wrapped
+
+	pages := make([][]string, 0)
+	for start := 0; start < len(lines); start += lines_per_page {
+		end := start + lines_per_page
+		if end > len(lines) {
+			end = len(lines)
+		}
+		pages = append(pages, lines[start:end])
+	}
+	if len(pages) == 0 {
+		pages = append(pages, []string{})
+	}
+
+	// Objects 1 and 2 are the catalog and page tree, 3 the font, then a
+	// page and its content stream for each page
+	objects := make([]string, 0)
+	kids := make([]string, 0)
+	for i := range pages {
+		kids = append(kids, fmt.Sprintf("%d 0 R", 4+2*i))
+	}
+	objects = append(objects, "<< /Type /Catalog /Pages 2 0 R >>")
+	objects = append(objects, fmt.Sprintf("<< /Type /Pages /Kids [%s] /Count %d >>",
+		strings.Join(kids, " "), len(pages)))
+	objects = append(objects, "<< /Type /Font /Subtype /Type1 /BaseFont /Courier >>")
+	for i, page := range pages {
+		var content bytes.Buffer
+		content.WriteString("BT /F1 9 Tf 11 TL 50 750 Td\n")
+		for _, line := range page {
+			fmt.Fprintf(&content, "(%s) '\n", pdf_escape(line))
+		}
+		content.WriteString("ET")
+		objects = append(objects, fmt.Sprintf(
+			"<< /Type /Page /Parent 2 0 R /MediaBox [0 0 612 792] "+
+				"/Resources << /Font << /F1 3 0 R >> >> /Contents %d 0 R >>", 5+2*i))
+		objects = append(objects, fmt.Sprintf("<< /Length %d >>\nstream\n%s\nendstream",
+			content.Len(), content.String()))
+	}
+
+	var pdf bytes.Buffer
+	pdf.WriteString("%PDF-1.4\n")
+	offsets := make([]int, 0)
+	for i, object := range objects {
+		offsets = append(offsets, pdf.Len())
+		fmt.Fprintf(&pdf, "%d 0 obj\n%s\nendobj\n", i+1, object)
+	}
+	xref := pdf.Len()
+	fmt.Fprintf(&pdf, "xref\n0 %d\n0000000000 65535 f \n", len(objects)+1)
+	for _, offset := range offsets {
+		fmt.Fprintf(&pdf, "%010d 00000 n \n", offset)
+	}
+	fmt.Fprintf(&pdf, "trailer\n<< /Size %d /Root 1 0 R >>\nstartxref\n%d\n%%%%EOF\n",
+		len(objects)+1, xref)
+	return pdf.Bytes()
+}
+
+// Characters of 9pt Courier (5.4pt wide) that fit between the 50pt margins
+// of a 612pt wide page
+const pdf_line_width = 94
+
+// Split a line into lines of at most width characters, breaking at spaces
+// where possible. Continuation lines keep the line's indent, plus two spaces.
+func wrap_line(line string, width int) []string {
+	runes := []rune(line)
+	if len(runes) <= width {
+		return []string{line}
+	}
+	indent := 0
+	for indent < len(runes) && runes[indent] == ' ' {
+		indent++
+	}
+	continuation := indent + 2
+	if continuation > width/2 {
+		continuation = width / 2
+	}
+
+	wrapped := make([]string, 0)
+	prefix := 0
+	for {
+		if prefix+len(runes) <= width {
+			wrapped = append(wrapped, strings.Repeat(" ", prefix)+
+				strings.TrimRight(string(runes), " "))
+			return wrapped
+		}
+		end := width - prefix
+		cut := end
+		for cut > 0 && runes[cut] != ' ' {
+			cut--
+		}
+		if cut == 0 || prefix == 0 && cut <= indent {
+			cut = end
+		}
+		wrapped = append(wrapped, strings.Repeat(" ", prefix)+
+			strings.TrimRight(string(runes[:cut]), " "))
+		runes = []rune(strings.TrimLeft(string(runes[cut:]), " "))
+		prefix = continuation
+		if len(runes) == 0 {
+			return wrapped
+		}
+	}
+}
+
+// Escape a line for a PDF string. Characters outside ASCII are replaced, as
+// the standard fonts only cover Latin-1 and the PDF is written as bytes.
+func pdf_escape(line string) string {
+	var escaped strings.Builder
+	for _, r := range line {
+		if r == '(' || r == ')' || r == '\\' {
+			escaped.WriteRune('\\')
+			escaped.WriteRune(r)
+		} else if r < 32 || r > 126 {
+			escaped.WriteRune('?')
+		} else {
+			escaped.WriteRune(r)
+		}
+	}
+	return escaped.String()
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestWrapLine(t *testing.T) {
+	cases := []struct {
+		line string
+		want []string
+	}{
+		{"short", []string{"short"}},
+		{"exactly 10", []string{"exactly 10"}},
+		{"aaaa bbbb cccc", []string{"aaaa bbbb", "  cccc"}},
+		{"  item with long text", []string{"  item", "    with", "    long", "    text"}},
+		{"abcdefghijklmnop", []string{"abcdefghij", "  klmnop"}},
+		{"aaaa bbbb      ", []string{"aaaa bbbb"}},
+	}
+	for _, c := range cases {
+		if got := wrap_line(c.line, 10); !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%q: got %q, want %q", c.line, got, c.want)
+		}
+	}
+}
+
+func TestTextPdf(t *testing.T) {
+	cases := []struct {
+		name  string
+		lines []string
+		pages int
+	}{
+		{"empty", []string{}, 1},
+		{"one page", make([]string, 60), 1},
+		{"two pages", make([]string, 61), 2},
+		{"wrapped lines take more room", append(make([]string, 59),
+			strings.Repeat("word ", 40)), 2},
+	}
+	for _, c := range cases {
+		pdf := text_pdf(c.lines)
+		if !bytes.HasPrefix(pdf, []byte("%PDF-1.4\n")) || !bytes.HasSuffix(pdf, []byte("%%EOF\n")) {
+			t.Errorf("%s: not a PDF", c.name)
+		}
+		if count := bytes.Count(pdf, []byte("/Type /Page ")); count != c.pages {
+			t.Errorf("%s: got %d pages, want %d", c.name, count, c.pages)
+		}
+	}
+}
@@ -0,0 +1,603 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+)
+
+/*
+ * A readable JSON document describing degree templates, so that they can be
+ * kept in version control and reviewed as diffs. Classes are written as their
+ * subject callsign and course number ("COMP 15"), class categories and
+ * templates by name.
+ */
+
+const template_date_format = "2006-01-02"
+
+type TemplateFile struct {
+	Templates  []*TemplateDocument
+	Categories []*CategoryDocument `json:",omitempty"`
+}
+
+type TemplateDocument struct {
+	Name         string
+	Program      string `json:",omitempty"`
+	Catalog_year int64  `json:",omitempty"`
+	// Dates in YYYY-MM-DD form
+	Effective_from string `json:",omitempty"`
+	Effective_to   string `json:",omitempty"`
+	Rules          []*RuleDocument
+}
+
+type RuleDocument struct {
+	// One of the ruletype names in ds_category_ruletype
+	Type             string
+	Class            string  `json:",omitempty"`
+	Category         string  `json:",omitempty"`
+	Template         string  `json:",omitempty"`
+	Min_count        int64   `json:",omitempty"`
+	Min_credits      float64 `json:",omitempty"`
+	Min_grade        string  `json:",omitempty"`
+	Passfail_allowed *bool   `json:",omitempty"`
+}
+
+type CategoryDocument struct {
+	Name     string
+	Classes  []string           `json:",omitempty"`
+	Patterns []*PatternDocument `json:",omitempty"`
+	Exclude  []string           `json:",omitempty"`
+}
+
+type PatternDocument struct {
+	Subject    string
+	Number_min *int64 `json:",omitempty"`
+	Number_max *int64 `json:",omitempty"`
+}
+
+// Problems with a template file that prevent it from being imported
+type TemplateFileError struct {
+	Problems []string
+}
+
+func (e *TemplateFileError) Error() string {
+	return strings.Join(e.Problems, "; ")
+}
+
+// Write out a template, every template it inherits and optionally the class
+// categories they use.
+func ExportTemplate(db *sql.DB, template_id int64, include_categories bool) (*TemplateFile, error) {
+	template, err := GetDSCategoryById(db, template_id)
+	if err != nil {
+		return nil, err
+	}
+
+	file := new(TemplateFile)
+	file.Templates = make([]*TemplateDocument, 0)
+	categories := make(map[int]*ClassCategory)
+	category_order := make([]int, 0)
+	visited := make(map[int64]bool)
+
+	var export func(template *DSCategory)
+	export = func(template *DSCategory) {
+		if visited[template.Id] {
+			return
+		}
+		visited[template.Id] = true
+
+		document := &TemplateDocument{
+			Name:         template.Name,
+			Program:      template.Program.String,
+			Catalog_year: template.Catalog_year.Int64,
+			Rules:        make([]*RuleDocument, 0),
+		}
+		if template.Effective_from.Valid {
+			document.Effective_from = template.Effective_from.Time.Format(template_date_format)
+		}
+		if template.Effective_to.Valid {
+			document.Effective_to = template.Effective_to.Time.Format(template_date_format)
+		}
+		file.Templates = append(file.Templates, document)
+		for _, rule := range template.Rules {
+			document.Rules = append(document.Rules, export_rule(rule))
+			if rule.class_category != nil {
+				if _, seen := categories[rule.class_category.Id]; !seen {
+					categories[rule.class_category.Id] = rule.class_category
+					category_order = append(category_order, rule.class_category.Id)
+				}
+			}
+		}
+		for _, rule := range template.Rules {
+			if rule.inherited != nil {
+				export(rule.inherited)
+			}
+		}
+	}
+	export(template)
+
+	if include_categories {
+		for _, category_id := range category_order {
+			document, err := export_class_category(db, categories[category_id])
+			if err != nil {
+				return nil, err
+			}
+			file.Categories = append(file.Categories, document)
+		}
+	}
+	return file, nil
+}
+
+func export_rule(rule *DSCategoryRule) *RuleDocument {
+	document := &RuleDocument{Type: ruletype_names[rule.Ruletype]}
+	if rule.class != nil {
+		document.Class = class_name(rule.class)
+	}
+	if rule.class_category != nil {
+		document.Category = rule.class_category.Name
+	}
+	if rule.inherited != nil {
+		document.Template = rule.inherited.Name
+	}
+	document.Min_count = rule.Min_count.Int64
+	document.Min_credits = rule.Min_credits.Float64
+	document.Min_grade = rule.Min_grade.String
+	if !rule.Passfail_allowed {
+		document.Passfail_allowed = &rule.Passfail_allowed
+	}
+	return document
+}
+
+func export_class_category(db *sql.DB, category *ClassCategory) (*CategoryDocument, error) {
+	rules, err := GetClassCategoryRules(db, int64(category.Id))
+	if err != nil {
+		return nil, err
+	}
+	document := &CategoryDocument{Name: category.Name}
+	for _, rule := range rules {
+		if !rule.Class_id.Valid {
+			pattern := &PatternDocument{Subject: rule.Subject.String}
+			if rule.Number_min.Valid {
+				pattern.Number_min = &rule.Number_min.Int64
+			}
+			if rule.Number_max.Valid {
+				pattern.Number_max = &rule.Number_max.Int64
+			}
+			document.Patterns = append(document.Patterns, pattern)
+			continue
+		}
+		class, err := GetClassById(db, rule.Class_id.Int64)
+		if err != nil {
+			return nil, err
+		}
+		if rule.Exclude {
+			document.Exclude = append(document.Exclude, class_name(class))
+		} else {
+			document.Classes = append(document.Classes, class_name(class))
+		}
+	}
+	return document, nil
+}
+
+// Load a template file into the database in a single transaction. Categories
+// and templates are matched to existing ones by name. The rules of an
+// existing template are updated in place, so that the IDs of rules that are
+// kept (and with them saved satisfaction maps) stay the same. Returns the IDs
+// of the imported templates by name.
+func ImportTemplateFile(db *sql.DB, file *TemplateFile) (map[string]int64, error) {
+	if err := check_template_file_inheritance(db, file); err != nil {
+		return nil, err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	template_ids, err := import_template_file(tx, file)
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	if err = tx.Commit(); err != nil {
+		return nil, err
+	}
+	return template_ids, nil
+}
+
+func import_template_file(tx *sql.Tx, file *TemplateFile) (map[string]int64, error) {
+	problems := make([]string, 0)
+
+	for _, category := range file.Categories {
+		category_problems, err := import_class_category(tx, category)
+		if err != nil {
+			return nil, err
+		}
+		problems = append(problems, category_problems...)
+	}
+
+	// Create any new templates first so that rules can refer to them
+	template_ids := make(map[string]int64)
+	for _, template := range file.Templates {
+		if _, duplicate := template_ids[template.Name]; duplicate {
+			problems = append(problems, fmt.Sprintf("Template %s is defined twice", template.Name))
+			continue
+		}
+		template_id, err := get_or_create_by_name(tx, "ds_category", template.Name)
+		if err != nil {
+			return nil, err
+		}
+		template_ids[template.Name] = template_id
+	}
+
+	for _, template := range file.Templates {
+		catalog_problems, err := import_catalog_info(tx, template_ids[template.Name], template)
+		if err != nil {
+			return nil, err
+		}
+		problems = append(problems, catalog_problems...)
+
+		template_problems, err := import_template_rules(tx, template_ids[template.Name], template)
+		if err != nil {
+			return nil, err
+		}
+		problems = append(problems, template_problems...)
+	}
+
+	if len(problems) > 0 {
+		return nil, &TemplateFileError{Problems: problems}
+	}
+	return template_ids, nil
+}
+
+// Set the program, catalog year and effective dates of a template. Fields the
+// document leaves out keep their current values.
+func import_catalog_info(tx *sql.Tx, template_id int64, template *TemplateDocument) ([]string, error) {
+	problems := make([]string, 0)
+	columns := make([]string, 0)
+	values := make([]interface{}, 0)
+	if template.Program != "" {
+		columns = append(columns, "program = ?")
+		values = append(values, template.Program)
+	}
+	if template.Catalog_year != 0 {
+		columns = append(columns, "catalog_year = ?")
+		values = append(values, template.Catalog_year)
+	}
+	dates := []struct {
+		column string
+		value  string
+	}{
+		{"effective_from", template.Effective_from},
+		{"effective_to", template.Effective_to},
+	}
+	for _, date := range dates {
+		if date.value == "" {
+			continue
+		}
+		parsed, err := time.Parse(template_date_format, date.value)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("Template %s: bad date %s",
+				template.Name, date.value))
+			continue
+		}
+		columns = append(columns, date.column+" = ?")
+		values = append(values, parsed)
+	}
+	if len(problems) > 0 || len(columns) == 0 {
+		return problems, nil
+	}
+
+	_, err := tx.Exec("UPDATE ds_category SET "+strings.Join(columns, ", ")+" WHERE id = ?",
+		append(values, template_id)...)
+	return problems, err
+}
+
+// Replace the definition of a class category. Returns the problems found
+// with the document, if any.
+func import_class_category(tx *sql.Tx, category *CategoryDocument) ([]string, error) {
+	problems := make([]string, 0)
+	category_id, err := get_or_create_by_name(tx, "class_category", category.Name)
+	if err != nil {
+		return nil, err
+	}
+	_, err = tx.Exec("DELETE FROM class_category_rule WHERE category = ?", category_id)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, pattern := range category.Patterns {
+		_, err = tx.Exec(`INSERT INTO class_category_rule
+			(category, subject, number_min, number_max) VALUES (?, ?, ?, ?)`,
+			category_id, pattern.Subject, pattern.Number_min, pattern.Number_max)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Listed classes first, then excluded ones
+	for i, names := range [][]string{category.Classes, category.Exclude} {
+		exclude := i == 1
+		for _, name := range names {
+			class_id, err := resolve_class_name(tx, name)
+			if err == sql.ErrNoRows {
+				problems = append(problems, fmt.Sprintf("Category %s: no class %s",
+					category.Name, name))
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+			_, err = tx.Exec(`INSERT INTO class_category_rule
+				(category, class_id, exclude) VALUES (?, ?, ?)`,
+				category_id, class_id, exclude)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	return problems, nil
+}
+
+// Bring the rules of a template in line with its document. Returns the
+// problems found with the document, if any.
+func import_template_rules(tx *sql.Tx, template_id int64, template *TemplateDocument) ([]string, error) {
+	problems := make([]string, 0)
+
+	// Existing rules, by what they refer to
+	existing := make(map[string]int64)
+	rows, err := tx.Query(`SELECT id, ruletype, class_id, category_id, inherited_id
+		FROM ds_category_rule WHERE category = ?`, template_id)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		rule := new(DSCategoryRule)
+		if err := rows.Scan(
+			&rule.Id,
+			&rule.Ruletype,
+			&rule.Class_id,
+			&rule.Category_id,
+			&rule.Inherit_id,
+		); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		existing[rule_target_key(rule)] = rule.Id
+	}
+	rows.Close()
+
+	kept := make(map[int64]bool)
+	for _, document := range template.Rules {
+		rule, problem, err := resolve_rule_document(tx, template_id, document)
+		if err != nil {
+			return nil, err
+		}
+		if problem == "" {
+			if err := check_ds_category_rule(rule); err != nil {
+				problem = err.Error()
+			}
+		}
+		if problem != "" {
+			problems = append(problems, fmt.Sprintf("Template %s: %s", template.Name, problem))
+			continue
+		}
+
+		rule_id, exists := existing[rule_target_key(rule)]
+		if exists && kept[rule_id] {
+			problems = append(problems, fmt.Sprintf("Template %s: duplicate %s rule",
+				template.Name, document.Type))
+			continue
+		}
+		if exists {
+			err = update_rule_options(tx, rule_id, rule)
+		} else {
+			rule_id, err = InsertDSCategoryRule(tx, rule)
+		}
+		if err != nil {
+			return nil, err
+		}
+		kept[rule_id] = true
+	}
+
+	for _, rule_id := range existing {
+		if kept[rule_id] {
+			continue
+		}
+		_, err := tx.Exec("DELETE FROM ds_category_rule WHERE id = ?", rule_id)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return problems, nil
+}
+
+// Turn a rule document into a rule, looking up what it refers to. Returns a
+// description of the problem if the document refers to something unknown.
+func resolve_rule_document(tx *sql.Tx, template_id int64, document *RuleDocument) (*DSCategoryRule, string, error) {
+	rule := new(DSCategoryRule)
+	rule.Category = template_id
+	for ruletype, name := range ruletype_names {
+		if name == document.Type {
+			rule.Ruletype = ruletype
+		}
+	}
+	if rule.Ruletype == 0 {
+		return nil, fmt.Sprintf("unknown rule type '%s'", document.Type), nil
+	}
+
+	if document.Class != "" {
+		class_id, err := resolve_class_name(tx, document.Class)
+		if err == sql.ErrNoRows {
+			return nil, fmt.Sprintf("no class %s", document.Class), nil
+		}
+		if err != nil {
+			return nil, "", err
+		}
+		rule.Class_id = sql.NullInt64{Int64: class_id, Valid: true}
+	}
+	if document.Category != "" {
+		var category_id int64
+		err := tx.QueryRow("SELECT id FROM class_category WHERE name = ?",
+			document.Category).Scan(&category_id)
+		if err == sql.ErrNoRows {
+			return nil, fmt.Sprintf("no category %s", document.Category), nil
+		}
+		if err != nil {
+			return nil, "", err
+		}
+		rule.Category_id = sql.NullInt64{Int64: category_id, Valid: true}
+	}
+	if document.Template != "" {
+		var inherited_id int64
+		err := tx.QueryRow("SELECT id FROM ds_category WHERE name = ?",
+			document.Template).Scan(&inherited_id)
+		if err == sql.ErrNoRows {
+			return nil, fmt.Sprintf("no template %s", document.Template), nil
+		}
+		if err != nil {
+			return nil, "", err
+		}
+		rule.Inherit_id = sql.NullInt64{Int64: inherited_id, Valid: true}
+	}
+
+	rule.Min_count = sql.NullInt64{Int64: document.Min_count, Valid: document.Min_count != 0}
+	rule.Min_credits = sql.NullFloat64{Float64: document.Min_credits, Valid: document.Min_credits != 0}
+	rule.Min_grade = sql.NullString{String: document.Min_grade, Valid: document.Min_grade != ""}
+	rule.Passfail_allowed = document.Passfail_allowed == nil || *document.Passfail_allowed
+	return rule, "", nil
+}
+
+// A key identifying what a rule refers to, used to match the rules of a
+// document with the rules already in the database
+func rule_target_key(rule *DSCategoryRule) string {
+	return fmt.Sprintf("%d:%d:%d:%d", rule.Ruletype, rule.Class_id.Int64,
+		rule.Category_id.Int64, rule.Inherit_id.Int64)
+}
+
+func update_rule_options(tx *sql.Tx, rule_id int64, rule *DSCategoryRule) error {
+	var passfail_allowed sql.NullInt64
+	if !rule.Passfail_allowed {
+		passfail_allowed = sql.NullInt64{Int64: 0, Valid: true}
+	}
+	_, err := tx.Exec(`UPDATE ds_category_rule SET passfail_allowed = ?,
+		min_count = ?, min_credits = ?, min_grade = ? WHERE id = ?`,
+		passfail_allowed, rule.Min_count, rule.Min_credits, rule.Min_grade, rule_id)
+	return err
+}
+
+// Look up a class by a name like "COMP 15". Returns sql.ErrNoRows if there is
+// no such class.
+func resolve_class_name(db sqlQueryer, name string) (int64, error) {
+	callsign, number, ok := parse_class_name(name)
+	if !ok {
+		return 0, sql.ErrNoRows
+	}
+	return get_class_id_by_callsign(db, callsign, number)
+}
+
+// Get the ID of the row of a table with a unique name, creating it if needed
+func get_or_create_by_name(tx *sql.Tx, table string, name string) (int64, error) {
+	var id int64
+	err := tx.QueryRow("SELECT id FROM "+table+" WHERE name = ?", name).Scan(&id)
+	if err == nil {
+		return id, nil
+	}
+	if err != sql.ErrNoRows {
+		return 0, err
+	}
+	result, err := tx.Exec("INSERT INTO "+table+" (name) VALUES (?)", name)
+	if err != nil {
+		return 0, err
+	}
+	return result.LastInsertId()
+}
+
+// Make sure that importing a file won't make any template inherit from
+// itself, either among the templates of the file or through templates already
+// in the database that inherit one of them.
+func check_template_file_inheritance(db *sql.DB, file *TemplateFile) error {
+	in_file := make(map[string]bool)
+	for _, template := range file.Templates {
+		in_file[template.Name] = true
+	}
+
+	// Edges from each template to the templates of the file it inherits
+	inherits := make(map[string][]string)
+	for _, template := range file.Templates {
+		for _, rule := range template.Rules {
+			if rule.Template == "" {
+				continue
+			}
+			inherits[template.Name] = append(inherits[template.Name], rule.Template)
+			if in_file[rule.Template] {
+				continue
+			}
+			if _, loaded := inherits[rule.Template]; loaded {
+				continue
+			}
+
+			// A template outside the file, which may itself inherit
+			// templates of the file
+			var inherited_id int64
+			err := db.QueryRow("SELECT id FROM ds_category WHERE name = ?",
+				rule.Template).Scan(&inherited_id)
+			if err == sql.ErrNoRows {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			inherited, err := GetDSCategoryById(db, inherited_id)
+			if err != nil {
+				return err
+			}
+			inherits[rule.Template] = make([]string, 0)
+			for name := range in_file {
+				var id int64
+				err := db.QueryRow("SELECT id FROM ds_category WHERE name = ?", name).Scan(&id)
+				if err == sql.ErrNoRows {
+					continue
+				}
+				if err != nil {
+					return err
+				}
+				if inheritance_path(inherited, id) != nil {
+					inherits[rule.Template] = append(inherits[rule.Template], name)
+				}
+			}
+		}
+	}
+
+	// Depth first search for a template that is reached from itself
+	const (
+		visiting = iota + 1
+		done
+	)
+	state := make(map[string]int)
+	var visit func(name string, path []string) []string
+	visit = func(name string, path []string) []string {
+		path = append(path, name)
+		if state[name] == visiting {
+			return path
+		}
+		if state[name] == done {
+			return nil
+		}
+		state[name] = visiting
+		for _, inherited := range inherits[name] {
+			if cycle := visit(inherited, path); cycle != nil {
+				return cycle
+			}
+		}
+		state[name] = done
+		return nil
+	}
+	for _, template := range file.Templates {
+		if cycle := visit(template.Name, make([]string, 0)); cycle != nil {
+			return &TemplateFileError{Problems: []string{
+				"Template inherits from itself: " + strings.Join(cycle, " -> "),
+			}}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// Rows of ds_category_rule: id, category, ruletype, class_id, category_id,
+// inherited_id, passfail_allowed, min_count, min_credits, min_grade
+var test_template_rules = map[int64][][]driver.Value{
+	1: {
+		{int64(10), int64(1), int64(RULE_CLASS), int64(15), nil, nil, nil, nil, nil, nil},
+		{int64(11), int64(1), int64(RULE_CATEGORY), nil, int64(5), nil, int64(0), nil, nil, "C-"},
+		{int64(12), int64(1), int64(RULE_INHERIT), nil, nil, int64(2), nil, nil, nil, nil},
+		{int64(13), int64(1), int64(RULE_COUNT), nil, int64(5), nil, nil, int64(2), nil, nil},
+	},
+	2: {
+		{int64(20), int64(2), int64(RULE_CREDITS), nil, int64(5), nil, nil, nil, 3.5, nil},
+	},
+}
+
+// A database with two templates, BSCS_2015 inheriting BSCS_2015_Free, the
+// classes COMP 11 and COMP 15, and the category Electives of both
+func open_template_db() *sql.DB {
+	effective_from := time.Date(2015, time.September, 1, 0, 0, 0, 0, time.UTC)
+	effective_to := time.Date(2016, time.September, 1, 0, 0, 0, 0, time.UTC)
+	db, _ := open_test_db(
+		&testResult{pattern: "FROM ds_category WHERE id", answer: func(args []driver.Value) [][]driver.Value {
+			if args[0].(int64) == 1 {
+				return [][]driver.Value{{int64(1), "BSCS_2015", "BSCS", int64(2015),
+					effective_from, effective_to}}
+			}
+			return [][]driver.Value{{int64(2), "BSCS_2015_Free", nil, nil, nil, nil}}
+		}},
+		&testResult{pattern: "FROM ds_category_rule WHERE category", answer: func(args []driver.Value) [][]driver.Value {
+			return test_template_rules[args[0].(int64)]
+		}},
+		&testResult{pattern: "class.credits_max FROM class", answer: func(args []driver.Value) [][]driver.Value {
+			return [][]driver.Value{{args[0], int64(1), "COMP", "Computer Science", args[0],
+				"Class", "", 1.0, nil}}
+		}},
+		&testResult{pattern: "FROM class_category WHERE id", rows: [][]driver.Value{
+			{int64(5), "Electives"},
+		}},
+		&testResult{pattern: "SELECT DISTINCT(class.id)", rows: [][]driver.Value{
+			{int64(11)}, {int64(15)},
+		}},
+	)
+	return db
+}
+
+func TestTemplateFileRoundTrip(t *testing.T) {
+	file, err := ExportTemplate(open_template_db(), 1, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	document, err := json.Marshal(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	imported := new(TemplateFile)
+	if err = json.Unmarshal(document, imported); err != nil {
+		t.Fatal(err)
+	}
+
+	template := imported.Templates[0]
+	if template.Name != "BSCS_2015" || template.Program != "BSCS" ||
+		template.Catalog_year != 2015 || template.Effective_from != "2015-09-01" ||
+		template.Effective_to != "2016-09-01" {
+		t.Errorf("got template %+v", template)
+	}
+
+	// Import into a database that has the templates, classes and categories
+	// but no rules, which should get the same rules back
+	db, fake := open_test_db(
+		&testResult{pattern: "SELECT id FROM ds_category WHERE name", answer: func(args []driver.Value) [][]driver.Value {
+			if args[0] == "BSCS_2015" {
+				return [][]driver.Value{{int64(1)}}
+			}
+			return [][]driver.Value{{int64(2)}}
+		}},
+		&testResult{pattern: "SELECT id FROM class_category WHERE name", rows: [][]driver.Value{
+			{int64(5)},
+		}},
+		&testResult{pattern: "AND class.course_number = ?", answer: func(args []driver.Value) [][]driver.Value {
+			return [][]driver.Value{{args[1]}}
+		}},
+	)
+	template_ids, err := ImportTemplateFile(db, imported)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(template_ids, map[string]int64{"BSCS_2015": 1, "BSCS_2015_Free": 2}) {
+		t.Errorf("got template IDs %v", template_ids)
+	}
+
+	inserted := fake.ran("INSERT INTO ds_category_rule")
+	want := append(append([][]driver.Value{}, test_template_rules[1]...), test_template_rules[2]...)
+	if len(inserted) != len(want) {
+		t.Fatalf("inserted %d rules, want %d", len(inserted), len(want))
+	}
+	for i, statement := range inserted {
+		// Everything but the rule ID
+		if !reflect.DeepEqual(statement.args, want[i][1:]) {
+			t.Errorf("rule %d: inserted %v, want %v", i, statement.args, want[i][1:])
+		}
+	}
+	if len(fake.ran("COMMIT")) != 1 {
+		t.Errorf("import not committed")
+	}
+}
+
+func TestImportCatalogInfo(t *testing.T) {
+	cases := []struct {
+		name     string
+		template *TemplateDocument
+		// The UPDATE run, empty if none
+		update   string
+		problems int
+	}{
+		{"all fields", &TemplateDocument{Name: "BSCS_2015", Program: "BSCS", Catalog_year: 2015,
+			Effective_from: "2015-09-01", Effective_to: "2016-09-01"},
+			"UPDATE ds_category SET program = ?, catalog_year = ?, effective_from = ?, effective_to = ? WHERE id = ?", 0},
+		{"omitted fields are left alone", &TemplateDocument{Name: "BSCS_2015", Catalog_year: 2016},
+			"UPDATE ds_category SET catalog_year = ? WHERE id = ?", 0},
+		{"no catalog info", &TemplateDocument{Name: "BSCS_2015_Free"}, "", 0},
+		{"bad date", &TemplateDocument{Name: "BSCS_2015", Program: "BSCS",
+			Effective_from: "September 2015"}, "", 1},
+	}
+	for _, c := range cases {
+		db, fake := open_test_db()
+		tx, err := db.Begin()
+		if err != nil {
+			t.Fatal(err)
+		}
+		problems, err := import_catalog_info(tx, 1, c.template)
+		tx.Rollback()
+		if err != nil {
+			t.Errorf("%s: %v", c.name, err)
+			continue
+		}
+		if len(problems) != c.problems {
+			t.Errorf("%s: got problems %q, want %d", c.name, problems, c.problems)
+		}
+		updates := fake.ran("UPDATE ds_category")
+		if c.update == "" && len(updates) > 0 {
+			t.Errorf("%s: ran %q, want no update", c.name, updates[0].query)
+		} else if c.update != "" && (len(updates) != 1 || updates[0].query != c.update) {
+			t.Errorf("%s: ran %d updates, want %q", c.name, len(updates), c.update)
+		}
+	}
+}
+
+// The checked in template must keep the catalog info the database has, or
+// importing it would leave Add_sheet unable to find it by program
+func TestTemplateFilesHaveCatalogInfo(t *testing.T) {
+	data, err := os.ReadFile("templates/BSCS_2015.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	file := new(TemplateFile)
+	if err = json.Unmarshal(data, file); err != nil {
+		t.Fatal(err)
+	}
+	template := file.Templates[0]
+	if template.Name != "BSCS_2015" || template.Program != "BSCS" || template.Catalog_year != 2015 {
+		t.Errorf("got %s, program %q, catalog year %d", template.Name, template.Program,
+			template.Catalog_year)
+	}
+}
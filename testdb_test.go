@@ -0,0 +1,203 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+)
+
+/*
+ * A database/sql driver for tests that answers queries from canned results
+ * and records the statements it is sent.
+ */
+
+// The rows returned for queries containing a pattern. answer, if set, is
+// called with the query's arguments instead of returning rows.
+type testResult struct {
+	pattern string
+	rows    [][]driver.Value
+	answer  func(args []driver.Value) [][]driver.Value
+	err     error
+}
+
+// A statement run with Exec, with its whitespace collapsed
+type testStatement struct {
+	query string
+	args  []driver.Value
+}
+
+type testDB struct {
+	mutex   sync.Mutex
+	results []*testResult
+	// Every statement run with Exec, and BEGIN, COMMIT and ROLLBACK
+	statements []*testStatement
+	// Rows affected by Exec statements containing a pattern, 1 otherwise
+	affected  map[string]int64
+	insert_id int64
+}
+
+// Open a database answering queries with the first result whose pattern the
+// query contains. Queries without a result return no rows.
+func open_test_db(results ...*testResult) (*sql.DB, *testDB) {
+	fake := &testDB{results: results, affected: make(map[string]int64)}
+	return sql.OpenDB(fake), fake
+}
+
+// The recorded statements containing a pattern
+func (d *testDB) ran(pattern string) []*testStatement {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	matching := make([]*testStatement, 0)
+	for _, statement := range d.statements {
+		if strings.Contains(statement.query, pattern) {
+			matching = append(matching, statement)
+		}
+	}
+	return matching
+}
+
+func (d *testDB) record(query string, args []driver.Value) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.statements = append(d.statements, &testStatement{
+		query: strings.Join(strings.Fields(query), " "),
+		args:  args,
+	})
+}
+
+func (d *testDB) Connect(ctx context.Context) (driver.Conn, error) {
+	return &testConn{db: d}, nil
+}
+
+func (d *testDB) Driver() driver.Driver {
+	return d
+}
+
+func (d *testDB) Open(name string) (driver.Conn, error) {
+	return &testConn{db: d}, nil
+}
+
+type testConn struct {
+	db *testDB
+}
+
+func (c *testConn) Prepare(query string) (driver.Stmt, error) {
+	return &testStmt{db: c.db, query: query}, nil
+}
+
+func (c *testConn) Close() error {
+	return nil
+}
+
+func (c *testConn) Begin() (driver.Tx, error) {
+	c.db.record("BEGIN", nil)
+	return &testTx{db: c.db}, nil
+}
+
+type testTx struct {
+	db *testDB
+}
+
+func (t *testTx) Commit() error {
+	t.db.record("COMMIT", nil)
+	return nil
+}
+
+func (t *testTx) Rollback() error {
+	t.db.record("ROLLBACK", nil)
+	return nil
+}
+
+type testStmt struct {
+	db    *testDB
+	query string
+}
+
+func (s *testStmt) Close() error {
+	return nil
+}
+
+func (s *testStmt) NumInput() int {
+	return -1
+}
+
+func (s *testStmt) Exec(args []driver.Value) (driver.Result, error) {
+	s.db.record(s.query, args)
+	s.db.mutex.Lock()
+	defer s.db.mutex.Unlock()
+	for _, result := range s.db.results {
+		if result.err != nil && strings.Contains(s.query, result.pattern) {
+			return nil, result.err
+		}
+	}
+	affected := int64(1)
+	for pattern, count := range s.db.affected {
+		if strings.Contains(s.query, pattern) {
+			affected = count
+		}
+	}
+	s.db.insert_id++
+	return &testExecResult{s.db.insert_id, affected}, nil
+}
+
+func (s *testStmt) Query(args []driver.Value) (driver.Rows, error) {
+	for _, result := range s.db.results {
+		if !strings.Contains(s.query, result.pattern) {
+			continue
+		}
+		if result.err != nil {
+			return nil, result.err
+		}
+		rows := result.rows
+		if result.answer != nil {
+			rows = result.answer(args)
+		}
+		return &testRows{rows: rows}, nil
+	}
+	return &testRows{}, nil
+}
+
+type testExecResult struct {
+	insert_id int64
+	affected  int64
+}
+
+func (r *testExecResult) LastInsertId() (int64, error) {
+	return r.insert_id, nil
+}
+
+func (r *testExecResult) RowsAffected() (int64, error) {
+	return r.affected, nil
+}
+
+type testRows struct {
+	rows [][]driver.Value
+	next int
+}
+
+func (r *testRows) Columns() []string {
+	columns := make([]string, 0)
+	if len(r.rows) > 0 {
+		for i := range r.rows[0] {
+			columns = append(columns, fmt.Sprintf("column%d", i))
+		}
+	}
+	return columns
+}
+
+func (r *testRows) Close() error {
+	return nil
+}
+
+func (r *testRows) Next(dest []driver.Value) error {
+	if r.next >= len(r.rows) {
+		return io.EOF
+	}
+	copy(dest, r.rows[r.next])
+	r.next++
+	return nil
+}
@@ -0,0 +1,285 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+/*
+ * Import of taken courses from a CSV file (subject, number, term, grade,
+ * pass/fail) or from the text of an unofficial transcript, where term
+ * headings such as "Fall 2015" are followed by lines like
+ * "COMP 15  Data Structures  A-  1.00".
+ */
+
+// One line of an imported transcript and what it was matched to
+type TranscriptLine struct {
+	Line     int
+	Text     string
+	Class_id int64
+	Class    string
+	Year     int64
+	Semester int64
+	Grade    string
+	Passfail bool
+	// Set if the line could not be imported
+	Error string
+	// Set if the course is already on the sheet, or earlier in the transcript
+	Duplicate bool
+}
+
+type TranscriptImport struct {
+	Imported   int
+	Lines      []*TranscriptLine
+	Unresolved []*TranscriptLine
+	// Lines not imported because the course is already on the sheet
+	Skipped []*TranscriptLine
+}
+
+var term_season_year_pattern = regexp.MustCompile(`(?i)^\s*(spring|fall)\s+(\d{4})\s*$`)
+var term_year_season_pattern = regexp.MustCompile(`(?i)^\s*(\d{4})\s+(spring|fall)\s*$`)
+var term_numeric_pattern = regexp.MustCompile(`^\s*(\d{4})\s*[-/]\s*(\d)\s*$`)
+
+var transcript_course_pattern = regexp.MustCompile(`^\s*([A-Z]{2,5})[\s-]*0*(\d{1,4})\b(.*)$`)
+
+// Parse a term such as "Fall 2015", "2015 Fall" or "2015-2"
+func parse_term(term string) (int64, int64, bool) {
+	season, year_s := "", ""
+	if match := term_season_year_pattern.FindStringSubmatch(term); match != nil {
+		season, year_s = match[1], match[2]
+	} else if match := term_year_season_pattern.FindStringSubmatch(term); match != nil {
+		year_s, season = match[1], match[2]
+	} else if match := term_numeric_pattern.FindStringSubmatch(term); match != nil {
+		year, _ := strconv.ParseInt(match[1], 10, 64)
+		semester, _ := strconv.ParseInt(match[2], 10, 64)
+		return year, semester, semester >= 1 && semester <= semesters_per_year
+	} else {
+		return 0, 0, false
+	}
+
+	year, _ := strconv.ParseInt(year_s, 10, 64)
+	if strings.ToLower(season) == "spring" {
+		return year, 1, true
+	}
+	return year, 2, true
+}
+
+func parse_passfail(value string) bool {
+	switch strings.ToLower(strings.TrimSpace(value)) {
+	case "1", "y", "yes", "true", "p/f", "pf", "pass/fail":
+		return true
+	}
+	return false
+}
+
+// Whether transcript data looks like CSV rather than transcript text
+func transcript_is_csv(data string) bool {
+	for _, line := range strings.Split(data, "\n") {
+		if strings.TrimSpace(line) != "" {
+			return strings.Contains(line, ",")
+		}
+	}
+	return false
+}
+
+// Parse CSV transcript data. A header row is skipped if present.
+func parse_transcript_csv(data string) ([]*TranscriptLine, error) {
+	reader := csv.NewReader(strings.NewReader(data))
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+
+	lines := make([]*TranscriptLine, 0)
+	for number := 1; ; number++ {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		line := &TranscriptLine{Line: number, Text: strings.Join(record, ",")}
+		if number == 1 && len(record) > 0 &&
+			strings.EqualFold(strings.TrimSpace(record[0]), "subject") {
+			continue
+		}
+		if len(record) < 4 {
+			line.Error = "Expected subject, number, term, grade and pass/fail"
+			lines = append(lines, line)
+			continue
+		}
+
+		line.Class = fmt.Sprintf("%s %s", strings.ToUpper(strings.TrimSpace(record[0])),
+			strings.TrimSpace(record[1]))
+		line.Grade = strings.ToUpper(strings.TrimSpace(record[3]))
+		if len(record) > 4 {
+			line.Passfail = parse_passfail(record[4])
+		}
+		var ok bool
+		line.Year, line.Semester, ok = parse_term(record[2])
+		if !ok {
+			line.Error = fmt.Sprintf("Unknown term %s", strings.TrimSpace(record[2]))
+		}
+		lines = append(lines, line)
+	}
+	return lines, nil
+}
+
+// Parse the text of an unofficial transcript. Lines that are neither a term
+// heading nor start with a class are skipped.
+func parse_transcript_text(data string) []*TranscriptLine {
+	lines := make([]*TranscriptLine, 0)
+	var year, semester int64
+	for number, text := range strings.Split(data, "\n") {
+		text = strings.TrimRight(text, "\r")
+		if term_year, term_semester, ok := parse_term(text); ok {
+			year, semester = term_year, term_semester
+			continue
+		}
+		match := transcript_course_pattern.FindStringSubmatch(text)
+		if match == nil {
+			continue
+		}
+
+		line := &TranscriptLine{
+			Line:     number + 1,
+			Text:     strings.TrimSpace(text),
+			Class:    fmt.Sprintf("%s %s", strings.ToUpper(match[1]), match[2]),
+			Year:     year,
+			Semester: semester,
+		}
+		// The grade is the last word on the line that is in the grade scale
+		words := strings.Fields(match[3])
+		for i := len(words) - 1; i >= 0; i-- {
+			if grade, known := ParseGrade(words[i]); known {
+				line.Grade = grade.Letter
+				line.Passfail = grade.Letter == "P" || grade.Letter == "NP"
+				break
+			}
+		}
+		if year == 0 {
+			line.Error = "No term heading before this line"
+		}
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+// Look up the class of a transcript line by its subject callsign and course
+// number, falling back to former course numbers. Classes that don't exist are
+// reported in the line, errors looking them up are returned.
+func resolve_transcript_class(db sqlQueryer, line *TranscriptLine) error {
+	callsign, number, ok := parse_class_name(line.Class)
+	if !ok {
+		line.Error = fmt.Sprintf("Unknown class %s", line.Class)
+		return nil
+	}
+	class_id, err := get_class_id_by_callsign(db, callsign, number)
+	if err == sql.ErrNoRows {
+		err = db.QueryRow(`SELECT class_id FROM class_former_number
+			WHERE subject = ? AND course_number = ?`, callsign, number).Scan(&class_id)
+	}
+	if err == sql.ErrNoRows {
+		line.Error = fmt.Sprintf("Unknown class %s", line.Class)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	line.Class_id = class_id
+	return nil
+}
+
+// The classes and terms of the courses already on a sheet
+func get_sheet_taken_keys(db sqlQueryer, sheet_id int64) (map[takenCourseKey]bool, error) {
+	rows, err := db.Query("SELECT class_id, year, semester FROM taken_courses WHERE sheet_id = ?",
+		sheet_id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	keys := make(map[takenCourseKey]bool)
+	for rows.Next() {
+		var class_id, year, semester int64
+		if err := rows.Scan(&class_id, &year, &semester); err != nil {
+			return nil, err
+		}
+		keys[takenCourseKey{class_id, term_index(year, semester)}] = true
+	}
+	return keys, rows.Err()
+}
+
+// Parse transcript data and add its courses to a sheet in one transaction.
+// Lines that cannot be resolved are reported and not imported, as are courses
+// the sheet already has in the same term. Nothing is saved if dry_run is set.
+func ImportTranscript(db *sql.DB, user_id int64, sheet_id int64, data string,
+	dry_run bool) (*TranscriptImport, error) {
+	var lines []*TranscriptLine
+	if transcript_is_csv(data) {
+		var err error
+		if lines, err = parse_transcript_csv(data); err != nil {
+			return nil, err
+		}
+	} else {
+		lines = parse_transcript_text(data)
+	}
+
+	existing, err := get_sheet_taken_keys(db, sheet_id)
+	if err != nil {
+		return nil, err
+	}
+	result := &TranscriptImport{
+		Lines:      lines,
+		Unresolved: make([]*TranscriptLine, 0),
+		Skipped:    make([]*TranscriptLine, 0),
+	}
+	for _, line := range lines {
+		if line.Error == "" {
+			if err := resolve_transcript_class(db, line); err != nil {
+				return nil, err
+			}
+		}
+		if line.Error != "" {
+			result.Unresolved = append(result.Unresolved, line)
+			continue
+		}
+		key := takenCourseKey{line.Class_id, term_index(line.Year, line.Semester)}
+		if existing[key] {
+			line.Duplicate = true
+			result.Skipped = append(result.Skipped, line)
+		}
+		existing[key] = true
+	}
+	if dry_run {
+		return result, nil
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	for _, line := range lines {
+		if line.Error != "" || line.Duplicate {
+			continue
+		}
+		_, err = tx.Exec(`INSERT INTO taken_courses (
+			user_id, sheet_id, class_id, year, semester, grade, passfail
+		) VALUES (?, ?, ?, ?, ?, ?, ?)`,
+			user_id, sheet_id, line.Class_id, line.Year, line.Semester,
+			line.Grade, line.Passfail)
+		if err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+		result.Imported++
+	}
+	if err = tx.Commit(); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestParseTerm(t *testing.T) {
+	cases := []struct {
+		term     string
+		year     int64
+		semester int64
+		ok       bool
+	}{
+		{"Fall 2015", 2015, 2, true},
+		{"spring 2016", 2016, 1, true},
+		{"2015 Spring", 2015, 1, true},
+		{"  2014 FALL ", 2014, 2, true},
+		{"2015-2", 2015, 2, true},
+		{"2015/1", 2015, 1, true},
+		{"2015-3", 2015, 3, false},
+		{"Summer 2015", 0, 0, false},
+		{"COMP 15", 0, 0, false},
+		{"", 0, 0, false},
+	}
+	for _, c := range cases {
+		year, semester, ok := parse_term(c.term)
+		if ok != c.ok || (ok && (year != c.year || semester != c.semester)) {
+			t.Errorf("%q: got %d %d %v, want %d %d %v", c.term, year, semester, ok,
+				c.year, c.semester, c.ok)
+		}
+	}
+}
+
+// The parts of a transcript line that come from parsing it
+type parsedLine struct {
+	line     int
+	class    string
+	year     int64
+	semester int64
+	grade    string
+	passfail bool
+	failed   bool
+}
+
+func check_transcript_lines(t *testing.T, name string, lines []*TranscriptLine,
+	want []parsedLine) {
+	if len(lines) != len(want) {
+		t.Errorf("%s: got %d lines, want %d", name, len(lines), len(want))
+		return
+	}
+	for i, line := range lines {
+		got := parsedLine{line.Line, line.Class, line.Year, line.Semester, line.Grade,
+			line.Passfail, line.Error != ""}
+		if got != want[i] {
+			t.Errorf("%s: line %d got %+v, want %+v", name, i, got, want[i])
+		}
+	}
+}
+
+func TestParseTranscriptText(t *testing.T) {
+	cases := []struct {
+		name string
+		data string
+		want []parsedLine
+	}{
+		{
+			name: "term headings and courses",
+			data: "Unofficial Transcript\r\n" +
+				"Fall 2015\r\n" +
+				"COMP 15  Data Structures  A-  1.00\r\n" +
+				"MATH-0032  Calculus I  B+  1.00\r\n" +
+				"Term GPA 3.50\r\n" +
+				"Spring 2016\r\n" +
+				"COMP 40  Machine Structure  P  1.00\r\n" +
+				"ENG 1  Expository Writing\r\n",
+			want: []parsedLine{
+				{3, "COMP 15", 2015, 2, "A-", false, false},
+				{4, "MATH 32", 2015, 2, "B+", false, false},
+				{7, "COMP 40", 2016, 1, "P", true, false},
+				{8, "ENG 1", 2016, 1, "", false, false},
+			},
+		},
+		{
+			name: "course before any term heading",
+			data: "COMP 11  Intro to Computer Science  A  1.00\nFall 2015\nCOMP 15  Data Structures  B  1.00",
+			want: []parsedLine{
+				{1, "COMP 11", 0, 0, "A", false, true},
+				{3, "COMP 15", 2015, 2, "B", false, false},
+			},
+		},
+		{
+			name: "no courses",
+			data: "Fall 2015\n\nNothing here",
+			want: []parsedLine{},
+		},
+	}
+	for _, c := range cases {
+		check_transcript_lines(t, c.name, parse_transcript_text(c.data), c.want)
+	}
+}
+
+func TestParseTranscriptCsv(t *testing.T) {
+	cases := []struct {
+		name string
+		data string
+		want []parsedLine
+	}{
+		{
+			name: "header row is skipped",
+			data: "Subject,Number,Term,Grade,Pass/fail\n" +
+				"comp, 15, Fall 2015, a-, no\n" +
+				"COMP,40,2016-1,P,yes\n",
+			want: []parsedLine{
+				{2, "COMP 15", 2015, 2, "A-", false, false},
+				{3, "COMP 40", 2016, 1, "P", true, false},
+			},
+		},
+		{
+			name: "pass/fail column is optional",
+			data: "MATH,32,2015 Spring,B",
+			want: []parsedLine{
+				{1, "MATH 32", 2015, 1, "B", false, false},
+			},
+		},
+		{
+			name: "short rows and unknown terms are errors",
+			data: "COMP,15,Fall 2015\nCOMP,40,Summer 2016,A",
+			want: []parsedLine{
+				{1, "", 0, 0, "", false, true},
+				{2, "COMP 40", 0, 0, "A", false, true},
+			},
+		},
+	}
+	for _, c := range cases {
+		lines, err := parse_transcript_csv(c.data)
+		if err != nil {
+			t.Errorf("%s: %v", c.name, err)
+			continue
+		}
+		check_transcript_lines(t, c.name, lines, c.want)
+	}
+
+	if _, err := parse_transcript_csv("COMP,\"15,Fall 2015"); err == nil {
+		t.Errorf("malformed CSV: got no error")
+	}
+}